@@ -0,0 +1,71 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squidwarden_atomicfile_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "status.json")
+	for _, test := range []struct {
+		data string
+		err  error
+		want string
+	}{
+		{"first", nil, "first"},
+		{"second", nil, "second"},
+		{"half", errors.New("failed"), "second"},
+	} {
+		err := Write(fn, func(w io.Writer) error {
+			if _, err := io.WriteString(w, test.data); err != nil {
+				return err
+			}
+			return test.err
+		})
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.data, err, test.err)
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.data, got, test.want)
+		}
+		if fs, err := ioutil.ReadDir(dir); err != nil {
+			t.Fatal(err)
+		} else if len(fs) != 1 {
+			t.Errorf("%s: want only the file left, got %d files", test.data, len(fs))
+		}
+	}
+	if st, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	} else if got := st.Mode().Perm(); got != 0644 {
+		t.Errorf("got mode %v, want 0644", got)
+	}
+}
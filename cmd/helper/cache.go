@@ -0,0 +1,141 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// LRU cache of decisions, so that identical requests don't run through every
+// regex again. It holds decisions for one config, and is emptied when a new
+// one is loaded.
+
+import (
+	"container/list"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/google/squidwarden/policy"
+)
+
+// cacheKey is what a decision depends on, other than the time.
+type cacheKey struct {
+	user   string
+	src    string
+	proto  string
+	method string
+	uri    string
+
+	sni       string
+	certNames string
+}
+
+type cacheEntry struct {
+	key cacheKey
+	d   policy.Decision
+}
+
+type decisionCache struct {
+	size int
+
+	m       sync.Mutex
+	cfg     *policy.Config
+	lru     *list.List // Of *cacheEntry, most recently used first.
+	entries map[cacheKey]*list.Element
+	hits    int64
+	misses  int64
+}
+
+func newDecisionCache(size int) *decisionCache {
+	return &decisionCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// reset empties the cache for a new config. Must be called with the lock held.
+func (c *decisionCache) reset(cfg *policy.Config) {
+	if c.cfg != nil && *verbose > 1 {
+		log.Printf("Decision cache for previous policy: %d hits, %d misses, %d entries", c.hits, c.misses, c.lru.Len())
+	}
+	c.cfg = cfg
+	c.lru.Init()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.hits, c.misses = 0, 0
+	cacheEntries.Set(0)
+}
+
+// evaluate returns the cached decision for req, or evaluates it and caches
+// the result. Decisions are cached until they expire, and errors aren't.
+func (c *decisionCache) evaluate(cfg *policy.Config, req *policy.Request) (policy.Decision, error) {
+	creq := policy.Canonicalize(req)
+	k := cacheKey{
+		user:   strings.ToLower(creq.User),
+		src:    creq.Src,
+		proto:  creq.Proto,
+		method: creq.Method,
+		uri:    creq.URI,
+
+		sni:       creq.SNI,
+		certNames: strings.Join(creq.CertNames, " "),
+	}
+
+	c.m.Lock()
+	if c.cfg != cfg {
+		c.reset(cfg)
+	}
+	if e, ok := c.entries[k]; ok {
+		d := e.Value.(*cacheEntry).d
+		if d.Expires.IsZero() || req.Time.Before(d.Expires) {
+			c.lru.MoveToFront(e)
+			c.hits++
+			c.m.Unlock()
+			cacheHits.Inc()
+			return d, nil
+		}
+		c.lru.Remove(e)
+		delete(c.entries, k)
+		cacheEntries.Set(float64(c.lru.Len()))
+	}
+	c.misses++
+	c.m.Unlock()
+	cacheMisses.Inc()
+
+	// Evaluate without the lock, so that other workers aren't held up.
+	d, err := policy.EvaluateCanonical(cfg, creq)
+	if err != nil {
+		return d, err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.cfg != cfg {
+		// Config reloaded meanwhile.
+		return d, nil
+	}
+	if e, ok := c.entries[k]; ok {
+		// Another worker got there first.
+		e.Value.(*cacheEntry).d = d
+		c.lru.MoveToFront(e)
+		return d, nil
+	}
+	c.entries[k] = c.lru.PushFront(&cacheEntry{key: k, d: d})
+	if c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).key)
+	}
+	cacheEntries.Set(float64(c.lru.Len()))
+	return d, nil
+}
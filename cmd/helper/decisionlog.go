@@ -0,0 +1,183 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Structured decision log, one JSON object per line per decision.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/policy"
+)
+
+// decisionRecord is one line of the decision log.
+type decisionRecord struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Src     string    `json:"src"`
+	User    string    `json:"user,omitempty"`
+	Proto   string    `json:"proto"`
+	Method  string    `json:"method"`
+	URI     string    `json:"uri"`
+
+	// From the TLS handshake, if squid peeked at it.
+	SNI       string   `json:"sni,omitempty"`
+	CertNames []string `json:"cert_names,omitempty"`
+
+	SourceID string        `json:"source_id,omitempty"`
+	GroupID  string        `json:"group_id,omitempty"`
+	ACLID    string        `json:"acl_id,omitempty"`
+	RuleID   string        `json:"rule_id,omitempty"`
+	Action   policy.Action `json:"action"`
+
+	// If no rule matched, the group whose default action applied.
+	Default string `json:"default_group,omitempty"`
+
+	// The action wasn't enforced, since the group is monitored.
+	Monitor bool `json:"monitor,omitempty"`
+
+	// Time spent evaluating, in microseconds.
+	LatencyUS int64 `json:"latency_us"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// decisionSink is somewhere decision log lines are written.
+type decisionSink interface {
+	// Write writes one line, without the trailing newline.
+	Write(line []byte) error
+
+	// Reopen reopens the underlying file, if any, after log rotation.
+	Reopen() error
+}
+
+// fileSink appends lines to a file.
+type fileSink struct {
+	path string
+
+	m sync.Mutex
+	f *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	s := &fileSink{path: path}
+	if err := s.Reopen(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) Write(line []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err := s.f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *fileSink) Reopen() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = f
+	return nil
+}
+
+// syslogSink sends lines to syslog.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(tag string) (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	return s.w.Info(string(line))
+}
+
+func (s *syslogSink) Reopen() error {
+	return nil
+}
+
+// newDecisionSink creates a sink from a -decision_log entry: "syslog",
+// "syslog:<tag>", or a file name.
+func newDecisionSink(spec string) (decisionSink, error) {
+	switch {
+	case spec == "syslog":
+		return newSyslogSink("squidwarden")
+	case strings.HasPrefix(spec, "syslog:"):
+		return newSyslogSink(strings.TrimPrefix(spec, "syslog:"))
+	case spec == "":
+		return nil, fmt.Errorf("empty decision log sink")
+	}
+	return newFileSink(spec)
+}
+
+// decisionLogger writes decision records to all its sinks.
+type decisionLogger struct {
+	sinks []decisionSink
+}
+
+// newDecisionLogger creates a logger from a comma separated list of sinks.
+func newDecisionLogger(specs string) (*decisionLogger, error) {
+	l := &decisionLogger{}
+	for _, spec := range strings.Split(specs, ",") {
+		s, err := newDecisionSink(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, fmt.Errorf("decision log %q: %v", spec, err)
+		}
+		l.sinks = append(l.sinks, s)
+	}
+	return l, nil
+}
+
+func (l *decisionLogger) log(rec *decisionRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to encode decision log record: %v", err)
+		return
+	}
+	for _, s := range l.sinks {
+		if err := s.Write(b); err != nil {
+			log.Printf("Failed to write decision log: %v", err)
+		}
+	}
+}
+
+func (l *decisionLogger) reopen() {
+	for _, s := range l.sinks {
+		if err := s.Reopen(); err != nil {
+			log.Printf("Failed to reopen decision log: %v", err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Keeping going when the database is locked or broken: from the last policy
+// loaded, from a snapshot of it, or failing open or closed, and saying so.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/squidwarden/atomicfile"
+	"github.com/google/squidwarden/policy"
+)
+
+// policyState is what the helper is deciding from.
+type policyState string
+
+const (
+	// Policy loaded from the database.
+	stateOK policyState = "ok"
+
+	// The database failed since, so the last policy loaded is used.
+	stateStale policyState = "stale"
+
+	// The database failed at startup, so the snapshot is used.
+	stateSnapshot policyState = "snapshot"
+
+	// No policy at all, so -fail_mode decides.
+	stateNone policyState = "none"
+)
+
+var allStates = []policyState{stateOK, stateStale, stateSnapshot, stateNone}
+
+// helperStatus is written to -status_file, for the UI to show.
+type helperStatus struct {
+	State    policyState `json:"state"`
+	Since    time.Time   `json:"since"`
+	Error    string      `json:"error,omitempty"`
+	FailMode string      `json:"fail_mode"`
+	PID      int         `json:"pid"`
+}
+
+var (
+	statusMu sync.Mutex
+	status   helperStatus
+)
+
+// setState records what the helper is deciding from, and reports changes.
+func setState(s policyState, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	var e string
+	if err != nil {
+		e = err.Error()
+	}
+	if s == status.State && e == status.Error {
+		return
+	}
+	if s != status.State {
+		status.Since = time.Now()
+		if s == stateOK {
+			if status.State != "" {
+				log.Printf("Policy loaded from the database, no longer degraded")
+			}
+		} else {
+			log.Printf("DEGRADED: policy state %q: %v", s, err)
+		}
+	}
+	status.State = s
+	status.Error = e
+	status.FailMode = *failMode
+	status.PID = os.Getpid()
+	for _, st := range allStates {
+		v := 0.0
+		if st == s {
+			v = 1
+		}
+		policyStateGauge.Set(v, string(st))
+	}
+	if *statusFile != "" {
+		st := status
+		if err := atomicfile.Write(processFile(*statusFile, os.Getpid()), func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(&st)
+		}); err != nil {
+			log.Printf("Failed to write status file: %v", err)
+		}
+	}
+}
+
+func getState() policyState {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return status.State
+}
+
+// degrade records that loading from the database failed, while running on
+// cur.
+func degrade(cur *policy.Config, err error) {
+	switch s := getState(); {
+	case cur == nil:
+		setState(stateNone, err)
+	case s == stateOK || s == "":
+		setState(stateStale, err)
+	default:
+		setState(s, err)
+	}
+}
+
+// lastSnapshot is the config last written to -snapshot.
+var lastSnapshot *policy.Config
+
+// saveSnapshot writes the policy to -snapshot, if set and the policy changed
+// since it was last written. Databases without the generation counter are
+// reloaded every -reload_check, usually without changes.
+func saveSnapshot(cfg *policy.Config) {
+	if *snapshotFile == "" || (lastSnapshot != nil && cfg.SamePolicy(lastSnapshot)) {
+		return
+	}
+	if err := atomicfile.Write(*snapshotFile, cfg.WriteSnapshot); err != nil {
+		log.Printf("Failed to write policy snapshot: %v", err)
+		return
+	}
+	lastSnapshot = cfg
+}
+
+func loadSnapshot(fn string) (*policy.Config, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, written, err := policy.LoadSnapshot(f)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded policy snapshot %q written %v", fn, written)
+	return cfg, nil
+}
+
+// startupConfig loads the policy from the database, or if that fails from
+// the snapshot. If neither works it returns nil, and -fail_mode applies
+// until the database works.
+func startupConfig() *policy.Config {
+	cfg, err := loadConfig()
+	if err == nil {
+		setState(stateOK, nil)
+		saveSnapshot(cfg)
+		return cfg
+	}
+	log.Printf("Failed to load policy from database: %v", err)
+	if *snapshotFile != "" {
+		c, serr := loadSnapshot(*snapshotFile)
+		if serr == nil {
+			setState(stateSnapshot, err)
+			return c
+		}
+		log.Printf("Failed to load policy snapshot: %v", serr)
+	}
+	setState(stateNone, err)
+	return nil
+}
+
+// failReply is the reply when there's no policy at all.
+func failReply(token string) string {
+	if *failMode == "open" {
+		decisionsTotal.Inc("fail_open")
+		return fmt.Sprintf("%s %s message=%s", token, aclMatch, kvQuote("No policy loaded, failing open"))
+	}
+	decisionsTotal.Inc("fail_closed")
+	return fmt.Sprintf("%s %s message=%s", token, aclNoMatch, kvQuote("No policy loaded, failing closed"))
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Flushing of data aggregated in memory, like rule hits and the monitor log,
+// to the database.
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// aggregate is data collected in memory and flushed to the database now and
+// then.
+type aggregate interface {
+	// take returns what was collected since the last call, or nil if nothing
+	// was, and starts collecting anew.
+	take() batch
+
+	// putBack merges a batch that couldn't be written back in, to be written
+	// by the next flush.
+	putBack(batch)
+}
+
+// batch is data taken from an aggregate, to be written in one transaction.
+type batch interface {
+	write(tx *sql.Tx) error
+}
+
+// flushAggregate writes what a has collected to the database. If that fails
+// it's put back into a.
+func flushAggregate(a aggregate) error {
+	b := a.take()
+	if b == nil {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err == nil {
+		err = b.write(tx)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		a.putBack(b)
+	}
+	return err
+}
+
+// flushEvery flushes a every interval until stop is closed, logging failures
+// to write what.
+func flushEvery(a aggregate, what string, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := flushAggregate(a); err != nil {
+				log.Printf("Failed to write %s: %v", what, err)
+			}
+		}
+	}
+}
@@ -6,6 +6,10 @@ Configure with:
   acl ext_acl external ext
   http_access allow ext_acl
 
+To also match on users authenticated by squid, add %LOGIN (or %EXT_USER) after
+%URI. Sources named "user:<name>" then match that user. For other field
+orders, give the same fields with -format.
+
 Copyright 2016 Google Inc.
 
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -27,16 +31,20 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net"
-	"net/url"
 	"os"
-	"regexp"
-	"sort"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/google/squidwarden/metrics"
+	"github.com/google/squidwarden/policy"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -45,323 +53,449 @@ var (
 	logFile  = flag.String("log", "", "Logfile. Default to stderr.")
 	verbose  = flag.Int("v", 1, "Verbosity level.")
 	blockLog = flag.String("block_log", "", "Block log.")
-
-	db *sql.DB
+	workers  = flag.Int("workers", 4, "Number of requests to evaluate in parallel.")
+	format   = flag.String("format", defaultFormat, "Fields of request lines, as in the external_acl_type line. Fields after the URI may be missing.")
+
+	reloadCheck  = flag.Duration("reload_check", time.Second, "How often to check the database for policy changes.")
+	decisionLog  = flag.String("decision_log", "", `Comma separated list of where to log every decision as JSON lines: file names, "syslog" or "syslog:<tag>". Files are reopened on SIGHUP.`)
+	hitsFlush    = flag.Duration("hits_flush", time.Minute, "How often to write rule hit counts to the database. 0 disables counting.")
+	monitorFlush = flag.Duration("monitor_flush", time.Minute, "How often to write what monitored groups would have had blocked to the database. 0 disables logging it.")
+	metricsAddr  = flag.String("metrics_addr", "", "Address to serve metrics on, at /metrics. Only the first helper process to start serves. Empty disables it.")
+	metricsFile  = flag.String("metrics_file", "", "File to write metrics to, for the node exporter's textfile collector, with the process ID added before the extension. Empty disables it.")
+	metricsEvery = flag.Duration("metrics_interval", 15*time.Second, "How often to write -metrics_file.")
+	snapshotFile = flag.String("snapshot", "", "File to save the policy to whenever it's loaded, and to start from if the database can't be read.")
+	statusFile   = flag.String("status_file", "", "File to write the helper's state to when it changes, for the UI to show, with the process ID added before the extension. See -helper_status in the UI.")
+	failMode     = flag.String("fail_mode", "closed", `What to answer when there's no policy at all: "closed" blocks everything, "open" allows everything.`)
+	cacheSize    = flag.Int("cache_size", 10000, "How many decisions to cache. The cache is emptied when the policy changes. 0 disables it.")
+	replyTTL     = flag.Duration("ttl", 0, "Cache time to tell squid for every decision. If 0, only sent when a schedule change is coming sooner, and squid's ttl applies otherwise.")
+
+	db        *sql.DB
+	cache     *decisionCache
+	decisions *decisionLogger
+	hits      *hitCounter
+	monitor   *monitorLog
 )
 
-type action string
-
 const (
-	actionNone   action = "none"
-	actionBlock  action = "block"
-	actionIgnore action = "ignore"
-	actionAllow  action = "allow"
-
-	actionDefault = actionBlock
-
 	aclMatch   = "OK"
 	aclNoMatch = "ERR"
 )
 
-type source interface {
-	String() string
-	Contains(net.IP) bool
-	PrefixLen() int
+// kvQuote quotes a value for a squid kv-pair.
+func kvQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", " ", -1)
+	return `"` + s + `"`
 }
 
-type sourceMask struct {
-	host net.IP
-	mask net.IP
-}
-
-func (s *sourceMask) String() string {
-	return s.host.String() + "/" + s.mask.String()
-}
-
-func (s *sourceMask) Contains(a net.IP) bool {
-	for n := range s.host {
-		if s.host[n] != a[n]&s.mask[n] {
-			return false
+// annotations returns the kv-pairs to send to squid with the reply, starting
+// with a space: what decided in log=, why in message=, and ttl= if the
+// decision may change before squid's own ttl runs out.
+func annotations(d *policy.Decision, err error, now time.Time) string {
+	var l []string
+	if d.Found {
+		var ids []string
+		for _, kv := range [][2]string{
+			{"source", d.SourceID},
+			{"group", d.GroupID},
+			{"acl", d.ACLID},
+			{"rule", d.RuleID},
+		} {
+			if kv[1] != "" {
+				ids = append(ids, kv[0]+"="+kv[1])
+			}
+		}
+		if len(ids) > 0 {
+			l = append(l, "log="+kvQuote(strings.Join(ids, " ")))
 		}
 	}
-	return true
-}
-
-func (s *sourceMask) PrefixLen() int {
-	// This is used for sorting only.
-	// TODO: what should be sorted by?
-	return 0
-}
-
-type sourceNet net.IPNet
-
-func (s *sourceNet) Contains(a net.IP) bool {
-	return (*net.IPNet)(s).Contains(a)
-}
-
-func (s *sourceNet) String() string {
-	return (*net.IPNet)(s).String()
-}
 
-func (s *sourceNet) PrefixLen() int {
-	r, _ := s.Mask.Size()
-	return r
-}
-
-type sourceRule struct {
-	source source
-	rules  []string
-}
-
-type Config struct {
-	// Map from source to rules.
-	Sources []sourceRule
-	Rules   map[string]RuleAction
-}
-
-type Rule interface {
-	Check(proto, src, method, uri string) (bool, error)
-}
-
-type RuleAction struct {
-	rule   Rule
-	action action
-}
+	msg := decisionMessage(d, err)
+	if d.Monitor && err == nil && d.Action != policy.ActionAllow {
+		msg = fmt.Sprintf("Not enforced, group %s is monitored: %s", d.GroupID, msg)
+	}
+	l = append(l, "message="+kvQuote(msg))
 
-type DomainRule struct {
-	value string
+	ttl := *replyTTL
+	if !d.Expires.IsZero() {
+		if until := d.Expires.Sub(now); ttl == 0 || until < ttl {
+			ttl = until
+		}
+	}
+	if ttl > 0 {
+		secs := int64((ttl + time.Second - 1) / time.Second)
+		l = append(l, fmt.Sprintf("ttl=%d", secs))
+	}
+	return " " + strings.Join(l, " ")
 }
 
-func splitHostPortDefault(s, def string) (string, string) {
-	host, port, err := net.SplitHostPort(s)
-	if err != nil {
-		host = s
-		port = def
+// decisionMessage says why a decision was made, for people.
+func decisionMessage(d *policy.Decision, err error) string {
+	var msg string
+	switch {
+	case err != nil:
+		msg = fmt.Sprintf("Error: %v", err)
+	case !d.Found && d.DefaultGroup != "":
+		verb := "blocked"
+		if d.Action == policy.ActionAllow {
+			verb = "allowed"
+		}
+		msg = fmt.Sprintf("No rule matched, %s by default for group %s", verb, d.DefaultGroup)
+	case !d.Found && d.Action == policy.ActionAllow:
+		msg = "No rule matched, allowed by default"
+	case !d.Found:
+		msg = "No rule allows this"
+	case d.ACLID == "":
+		msg = fmt.Sprintf("Action %s", d.Action)
+	default:
+		name := d.ACLComment
+		if name == "" {
+			name = d.ACLID
+		}
+		verb := map[policy.Action]string{
+			policy.ActionAllow:  "Allowed",
+			policy.ActionIgnore: "Blocked (ignored)",
+			policy.ActionBlock:  "Blocked",
+		}[d.Action]
+		if verb == "" {
+			verb = "Blocked"
+		}
+		msg = fmt.Sprintf("%s by rule %s in ACL %q", verb, d.RuleID, name)
 	}
-	return host, port
+	return msg
 }
 
-func (d *DomainRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "HTTP" {
-		return false, nil
+// handleLine evaluates one request line from squid and returns the reply line,
+// including the channel token.
+func handleLine(cfg *policy.Config, line string) string {
+	if *verbose > 1 {
+		log.Printf("Got %q", line)
 	}
-	if d.value == "" {
-		return false, nil
-	}
-	p, err := url.Parse(uri)
+	r, err := inputFormat.parse(line)
+	if err != nil {
+		log.Printf("Malformed line %q: %v", line, err)
+		badLines.Inc()
+		return badReply(r.Channel, err)
+	}
+	if cfg == nil {
+		return failReply(r.Channel)
+	}
+	reply := aclNoMatch
+	start := time.Now()
+	req := &policy.Request{
+		Proto:     r.Proto,
+		Src:       r.Src,
+		Method:    r.Method,
+		URI:       r.URI,
+		User:      r.User,
+		SNI:       r.SNI,
+		CertNames: r.CertNames,
+		Time:      start,
+	}
+	var d policy.Decision
+	if cache != nil {
+		d, err = cache.evaluate(cfg, req)
+	} else {
+		d, err = policy.Evaluate(cfg, req)
+	}
+	latency := time.Since(start)
+	decisionsTotal.Inc(string(d.Action))
+	decisionSeconds.Observe(latency.Seconds())
 	if err != nil {
-		return false, err
+		log.Printf("Decision error on %q: %v", line, err)
+	}
+	if decisions != nil {
+		rec := &decisionRecord{
+			Time:      start,
+			Channel:   r.Channel,
+			Src:       r.Src,
+			User:      r.User,
+			Proto:     r.Proto,
+			Method:    r.Method,
+			URI:       r.URI,
+			SNI:       r.SNI,
+			CertNames: r.CertNames,
+			SourceID:  d.SourceID,
+			GroupID:   d.GroupID,
+			ACLID:     d.ACLID,
+			RuleID:    d.RuleID,
+			Action:    d.Action,
+			Monitor:   d.Monitor,
+			Default:   d.DefaultGroup,
+			LatencyUS: int64(latency / time.Microsecond),
+		}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		decisions.log(rec)
 	}
-
-	// If query doesn't have port, assume port 80.
-	ruleHost, rulePort := splitHostPortDefault(d.value, "80")
-	hostOnly, portOnly := splitHostPortDefault(p.Host, "80")
-
-	if portOnly != rulePort && rulePort != "*" {
-		return false, nil
+	if hits != nil && d.RuleID != "" {
+		hits.add(d.RuleID, start)
 	}
-
-	// Exact match.
-	if hostOnly == ruleHost {
-		return true, nil
+	switch {
+	case d.Monitor && err == nil && d.Action != policy.ActionAllow:
+		// Observe only. Ignored requests aren't logged, as usual.
+		reply = aclMatch
+		if *verbose > 0 {
+			log.Printf("Not enforced for monitored group %s (%s): %q", d.GroupID, d.Action, line)
+		}
+		if monitor != nil && d.Action != policy.ActionIgnore {
+			monitor.add(d.GroupID, monitorSite(r.Method, r.URI), r.URI, decisionMessage(&d, nil), start)
+		}
+	case d.Action == policy.ActionBlock, d.Action == policy.ActionNone:
+		if *verbose > 0 && reply != aclMatch {
+			log.Printf("No match(%s): %q", d.Action, line)
+		}
+		if err := logBlock(r.Proto, r.Src, r.Method, r.URI); err != nil {
+			log.Printf("Logging block: %v", err)
+		}
+	case d.Action == policy.ActionAllow:
+		reply = aclMatch
 	}
+	reply += annotations(&d, err, start)
+	if *verbose > 1 {
+		log.Printf("Replied: %s %s", r.Channel, reply)
+	}
+	return fmt.Sprintf("%s %s", r.Channel, reply)
+}
 
-	// If rule is CIDR, allow anything in it.
-	if _, cidr, err := net.ParseCIDR(ruleHost); err == nil {
-		if ip := net.ParseIP(hostOnly); ip != nil {
-			if cidr.Contains(ip) {
-				return true, nil
+// serve reads request lines from in and has n workers evaluate them in
+// parallel. Since squid tags every request with a channel token (concurrency=N)
+// replies are written to out as they complete, not in input order.
+//
+// serve returns when in reaches EOF or stop is closed, after all requests
+// already read have been answered.
+func serve(in io.Reader, out io.Writer, n int, getConfig func() *policy.Config, stop <-chan struct{}) error {
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-stop:
+				readErr <- nil
+				return
 			}
 		}
+		readErr <- scanner.Err()
+	}()
+
+	jobs := make(chan string)
+	replies := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range jobs {
+				replies <- handleLine(getConfig(), line)
+			}
+		}()
 	}
 
-	// Domain suffix.
-	if strings.HasPrefix(d.value, ".") {
-		// No extra level.
-		if "."+hostOnly == ruleHost {
-			return true, nil
+	writeDone := make(chan error, 1)
+	go func() {
+		var err error
+		for reply := range replies {
+			if err != nil {
+				// Keep draining so workers don't block.
+				continue
+			}
+			_, err = fmt.Fprintf(out, "%s\n", reply)
 		}
-		if strings.HasSuffix(hostOnly, ruleHost) {
-			return true, nil
+		writeDone <- err
+	}()
+
+loop:
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				break loop
+			}
+			jobs <- line
+		case <-stop:
+			break loop
 		}
 	}
-	return false, nil
-}
-
-type RegexRule struct {
-	re *regexp.Regexp
-}
-
-func (d *RegexRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "HTTP" {
-		return false, nil
+	close(jobs)
+	wg.Wait()
+	close(replies)
+	if err := <-writeDone; err != nil {
+		return err
 	}
-	if d.re.MatchString(uri) {
-		return true, nil
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		// Reader still blocked on input after stop. Nothing more to do.
+		return nil
 	}
-	return false, nil
-}
-
-type HTTPSRegexRule struct {
-	re *regexp.Regexp
 }
 
-func (d *HTTPSRegexRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "NONE" {
-		return false, nil
+// policyGeneration returns the policy generation counter, which is bumped by
+// triggers on every change to the policy tables.
+func policyGeneration() (int64, error) {
+	var gen int64
+	if err := db.QueryRow(`SELECT generation FROM generation`).Scan(&gen); err != nil {
+		return 0, err
 	}
-	if d.re.MatchString(uri) {
-		return true, nil
-	}
-	return false, nil
+	return gen, nil
 }
 
-type ExactRule struct {
-	value string
+// reloader reloads the config into current when the policy generation
+// changes, when a rule, grant or membership starts or stops being in effect,
+// or when something is sent on force. If loading fails the current config
+// is kept, and retried every check until it works.
+func reloader(current *atomic.Value, gen int64, force <-chan os.Signal) {
+	tick := time.NewTicker(*reloadCheck)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			g, err := policyGeneration()
+			cur := current.Load().(*policy.Config)
+			if err != nil {
+				// Database without generation counter. Reload every time.
+				if *verbose > 1 {
+					log.Printf("Failed to get policy generation: %v", err)
+				}
+			} else if cur != nil && g == gen && (cur.Changes.IsZero() || time.Now().Before(cur.Changes)) {
+				continue
+			}
+			gen = g
+		case <-force:
+			log.Printf("Got SIGHUP, reloading config")
+			if g, err := policyGeneration(); err == nil {
+				gen = g
+			}
+		}
+		st := time.Now()
+		cfg, err := loadConfig()
+		if err != nil {
+			log.Printf("Failed to reload database: %v", err)
+			// Make sure we try again next time.
+			gen = -1
+			cur := current.Load().(*policy.Config)
+			degrade(cur, err)
+			// Rules, grants and memberships still start and end on
+			// time while the database is away.
+			if cur != nil && !cur.Changes.IsZero() && !time.Now().Before(cur.Changes) {
+				if c, err := cur.Recompile(); err != nil {
+					log.Printf("Failed to recompile policy: %v", err)
+				} else {
+					current.Store(c)
+				}
+			}
+			continue
+		}
+		current.Store(cfg)
+		setState(stateOK, nil)
+		saveSnapshot(cfg)
+		if *verbose > 0 {
+			log.Printf("Loaded policy generation %d in %v", gen, time.Since(st))
+		}
+	}
 }
 
-func (d *ExactRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "HTTP" {
-		return false, nil
+func mainLoop() {
+	// Get generation before loading, so that changes during load trigger
+	// another reload.
+	gen, err := policyGeneration()
+	if err != nil {
+		log.Printf("Failed to get policy generation, will reload every %v: %v", *reloadCheck, err)
+	}
+	var current atomic.Value
+	current.Store(startupConfig())
+	if getState() != stateOK {
+		// Keep trying the database.
+		gen = -1
+	}
+
+	// Reload config in the background, so that a slow reload doesn't stall
+	// requests.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloader(&current, gen, hup)
+
+	// Reopen decision log files on SIGHUP too, for log rotation.
+	if decisions != nil {
+		reopen := make(chan os.Signal, 1)
+		signal.Notify(reopen, syscall.SIGHUP)
+		go func() {
+			for range reopen {
+				decisions.reopen()
+			}
+		}()
 	}
-	return d.value == uri, nil
-}
 
-type HTTPSDomainRule struct {
-	value string
-}
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Printf("Got SIGTERM, finishing in-flight requests")
+		close(stop)
+	}()
 
-func (d *HTTPSDomainRule) Check(proto, src, method, uri string) (bool, error) {
-	if proto != "NONE" {
-		return false, nil
-	}
-	if method != "CONNECT" {
-		return false, nil
+	if *cacheSize > 0 {
+		cache = newDecisionCache(*cacheSize)
 	}
-	dhost, dport := splitHostPortDefault(d.value, "443")
-	if dhost == "" {
-		return false, nil
+	if *hitsFlush > 0 {
+		hits = newHitCounter()
+		go flushEvery(hits, "rule hits", *hitsFlush, stop)
 	}
-	host, port, err := net.SplitHostPort(uri)
-	if err != nil {
-		return false, fmt.Errorf("failed to parse HTTPS host:port %q: %v", uri, err)
+	if *monitorFlush > 0 {
+		monitor = newMonitorLog()
+		go flushEvery(monitor, "monitor log", *monitorFlush, stop)
 	}
-	if port != dport && dport != "*" {
-		return false, nil
+	// Tell the helper processes apart.
+	metrics.Default.AddLabel("pid", strconv.Itoa(os.Getpid()))
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
 	}
-	// Exact hostname.
-	if host == dhost {
-		return true, nil
+	var metricsFn string
+	if *metricsFile != "" {
+		metricsFn = processFile(*metricsFile, os.Getpid())
+		go metricsWriter(metricsFn, *metricsEvery, stop)
 	}
 
-	// If rule is CIDR, allow those.
-	if _, cidr, err := net.ParseCIDR(dhost); err == nil {
-		if ip := net.ParseIP(host); ip != nil {
-			if cidr.Contains(ip) {
-				return true, nil
-			}
-		}
+	if err := serve(os.Stdin, os.Stdout, *workers, func() *policy.Config { return current.Load().(*policy.Config) }, stop); err != nil {
+		log.Fatal(err)
 	}
-
-	// Domain suffix.
-	if strings.HasPrefix(d.value, ".") {
-		// No extra level.
-		if "."+host == dhost {
-			return true, nil
-		}
-		if strings.HasSuffix(host, dhost) {
-			return true, nil
+	if hits != nil {
+		if err := flushAggregate(hits); err != nil {
+			log.Printf("Failed to write rule hits: %v", err)
 		}
 	}
-	return false, nil
-}
-
-// decide returns 'match found', 'action to take', error
-func decide(cfg *Config, proto, src, method, uri string) (bool, action, error) {
-	// Special case this because net/url can't parse these.
-	if strings.HasPrefix(uri, "cache_object://") {
-		return true, actionIgnore, nil
-	}
-
-	source := net.ParseIP(src)
-	if source == nil {
-		return false, actionNone, fmt.Errorf("source is not a valid address: %q", src)
+	if monitor != nil {
+		if err := flushAggregate(monitor); err != nil {
+			log.Printf("Failed to write monitor log: %v", err)
+		}
 	}
-	for _, rs := range cfg.Sources {
-		if !rs.source.Contains(source) {
-			continue
+	if *statusFile != "" {
+		// Don't leave the UI showing the state of an exited process.
+		if err := os.Remove(processFile(*statusFile, os.Getpid())); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove status file: %v", err)
 		}
-		for _, ruleName := range rs.rules {
-			rule := cfg.Rules[ruleName]
-			t, err := rule.rule.Check(proto, src, method, uri)
-			if err != nil {
-				log.Printf("Failed to evaluate rule %q: %v", ruleName, err)
-			} else if t {
-				return true, rule.action, nil
-			}
+	}
+	if metricsFn != "" {
+		// Don't leave the textfile collector exporting an exited process.
+		if err := os.Remove(metricsFn); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove metrics file: %v", err)
 		}
 	}
-	return false, actionDefault, nil
 }
 
-func mainLoop() {
-	cfg, err := loadConfig()
-	if err != nil {
-		log.Fatal(err)
-	}
-	// TODO: multithread this.
-	scanner := bufio.NewScanner(os.Stdin)
-	lastLoad := time.Now()
-	for scanner.Scan() {
-		if time.Since(lastLoad) > time.Second {
-			cfg2, err := loadConfig()
-			if err != nil {
-				log.Printf("Failed to reload database")
-			} else {
-				cfg = cfg2
-			}
-			lastLoad = time.Now()
-		}
-
-		s := strings.Split(scanner.Text(), " ")
-		if *verbose > 1 {
-			log.Printf("Got %q", s)
-		}
-		token := s[0]
-		proto := s[1]
-		src := s[2]
-		method := s[3]
-		uri := s[4]
-		urip, err := url.QueryUnescape(uri)
-		reply := aclNoMatch
-		if err != nil {
-			log.Printf("URI escape error on %q: %v", s, err)
-		} else {
-			_, act, err := decide(cfg, proto, src, method, urip)
-			if err != nil {
-				log.Printf("Decision error on %q: %v", s, err)
-			}
-			switch act {
-			case actionBlock, actionNone:
-				if *verbose > 0 && reply != aclMatch {
-					log.Printf("No match(%s): %q", act, s)
-				}
-				if err := logBlock(proto, src, method, urip); err != nil {
-					log.Printf("Logging block: %v", err)
-				}
-			case actionIgnore:
-			case actionAllow:
-				reply = aclMatch
-			}
-		}
-		if *verbose > 1 {
-			log.Printf("Replied: %s %s", token, reply)
-		}
-		fmt.Printf("%s %s\n", token, reply)
-	}
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
-	}
+// processFile returns fn with pid added before the extension. Squid gives
+// every helper process the same flags, so this keeps them from overwriting
+// each other's -status_file and -metrics_file.
+func processFile(fn string, pid int) string {
+	ext := filepath.Ext(fn)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(fn, ext), pid, ext)
 }
 
 func logBlock(proto, src, method, urip string) error {
@@ -384,131 +518,19 @@ func logBlock(proto, src, method, urip string) error {
 	return nil
 }
 
-func parseMask(s string) (source, error) {
-	re := regexp.MustCompile(`^([0-9a-fA-F:.]+)/([0-9a-fA-F:.]+)$`)
-	m := re.FindStringSubmatch(s)
-	if m == nil {
-		return nil, fmt.Errorf("not a host match")
-	}
-	a := net.ParseIP(m[1])
-	if a == nil {
-		return nil, fmt.Errorf("not a valid address: %q", m[1])
-	}
-	b := net.ParseIP(m[2])
-	if b == nil {
-		return nil, fmt.Errorf("not a valid address: %q", m[2])
-	}
-	return &sourceMask{host: a, mask: b}, nil
-}
-
-func loadConfig() (*Config, error) {
-	cfg := &Config{
-		Rules: make(map[string]RuleAction),
-	}
-	if err := func() error {
-		rows, err := db.Query(`
-SELECT sources.source, rules.rule_id
-FROM sources
-JOIN members ON sources.source_id=members.source_id
-JOIN groups ON members.group_id=groups.group_id
-JOIN groupaccess ON groups.group_id=groupaccess.group_id
-JOIN acls ON groupaccess.acl_id=acls.acl_id
-JOIN aclrules ON acls.acl_id=aclrules.acl_id
-JOIN rules ON aclrules.rule_id=rules.rule_id
-ORDER BY sources.source`)
-		if err != nil {
-			return err
-		}
-		defer rows.Close()
-		var prevSource source
-		var rs []string
-		for rows.Next() {
-			var src, rule string
-			if err := rows.Scan(&src, &rule); err != nil {
-				return err
-			}
-			var s source
-			if _, t, err := net.ParseCIDR(src); err != nil {
-				if t, err := parseMask(src); err != nil {
-					log.Printf("%q is not valid CIDR: %v", src, err)
-					continue
-				} else {
-					s = t
-				}
-			} else {
-				t := sourceNet(*t)
-				s = &t
-			}
-			if prevSource != nil && (prevSource.String() != s.String()) {
-				cfg.Sources = append(cfg.Sources, sourceRule{source: prevSource, rules: rs})
-				rs = nil
-			}
-			prevSource = s
-			rs = append(rs, rule)
-		}
-		if prevSource != nil {
-			cfg.Sources = append(cfg.Sources, sourceRule{source: prevSource, rules: rs})
-		}
-		return rows.Err()
-	}(); err != nil {
-		return nil, err
-	}
-
-	if err := func() error {
-		rows, err := db.Query(`
-SELECT rule_id, type, value, action
-FROM rules
-`)
-		if err != nil {
-			return err
-		}
-		defer rows.Close()
-		for rows.Next() {
-			var rule, typ, val, act string
-			if err := rows.Scan(&rule, &typ, &val, &act); err != nil {
-				return err
-			}
-			r := RuleAction{action: action(act)}
-			switch typ {
-			case "https-domain":
-				r.rule = &HTTPSDomainRule{value: val}
-			case "domain":
-				r.rule = &DomainRule{value: val}
-			case "exact":
-				r.rule = &ExactRule{value: val}
-			case "regex":
-				x, err := regexp.Compile("^" + val + "$")
-				if err != nil {
-					return fmt.Errorf("compiling regex %q: %v", val, err)
-				}
-				r.rule = &RegexRule{re: x}
-			case "https-regex":
-				x, err := regexp.Compile("^" + val + "$")
-				if err != nil {
-					return fmt.Errorf("compiling regex %q: %v", val, err)
-				}
-				r.rule = &HTTPSRegexRule{re: x}
-			default:
-				return fmt.Errorf("unknown rule type %q", typ)
-			}
-			cfg.Rules[rule] = r
-		}
-		return rows.Err()
-	}(); err != nil {
+func loadConfig() (*policy.Config, error) {
+	st := time.Now()
+	cfg, err := policy.Load(db)
+	reloadsTotal.Inc()
+	reloadSeconds.Observe(time.Since(st).Seconds())
+	if err != nil {
+		reloadFailures.Inc()
 		return nil, err
 	}
-	sort.Sort(sort.Reverse(byPrefixLen(cfg.Sources)))
+	ruleCount.Set(float64(len(cfg.Rules)))
 	return cfg, nil
 }
 
-type byPrefixLen []sourceRule
-
-func (a byPrefixLen) Len() int      { return len(a) }
-func (a byPrefixLen) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byPrefixLen) Less(i, j int) bool {
-	return a[i].source.PrefixLen() < a[j].source.PrefixLen()
-}
-
 func openDB() {
 	var err error
 	db, err = sql.Open("sqlite3", *dbFile)
@@ -516,7 +538,8 @@ func openDB() {
 		log.Fatalf("Failed to open database %q: %v", *dbFile, err)
 	}
 	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
-		log.Fatalf("Failed to turn on foreign keys")
+		// Not fatal, so that a snapshot or -fail_mode can take over.
+		log.Printf("Failed to turn on foreign keys: %v", err)
 	}
 }
 
@@ -526,6 +549,15 @@ func main() {
 	if flag.NArg() > 0 {
 		log.Fatalf("Extra args on cmdline: %q", flag.Args())
 	}
+	{
+		var err error
+		if inputFormat, err = parseFormat(*format); err != nil {
+			log.Fatalf("Bad -format: %v", err)
+		}
+	}
+	if *failMode != "open" && *failMode != "closed" {
+		log.Fatalf("-fail_mode must be open or closed, got %q", *failMode)
+	}
 	if *logFile != "" {
 		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 		if err != nil {
@@ -534,6 +566,12 @@ func main() {
 		defer f.Close()
 		log.SetOutput(f)
 	}
+	if *decisionLog != "" {
+		var err error
+		if decisions, err = newDecisionLogger(*decisionLog); err != nil {
+			log.Fatal(err)
+		}
+	}
 	openDB()
 	defer db.Close()
 	log.Printf("Running...")
@@ -17,12 +17,29 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/squidwarden/metrics"
+	"github.com/google/squidwarden/policy"
 )
 
 var (
@@ -64,109 +81,608 @@ func TestMain(m *testing.M) {
 	os.Exit(res)
 }
 
-func TestOrder(t *testing.T) {
+func TestServe(t *testing.T) {
 	cfg, err := loadConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
-	ss := []string{
-		"127.0.0.1/32",
-		"127.0.0.0/8",
-		"0.0.0.0/1",
-		"129.99.0.1/255.255.0.255",
-		"::1234:5678/::ffff:ffff",
+	want := map[string]string{}
+	var in bytes.Buffer
+	for n, test := range []struct {
+		line, reply string
+	}{
+		{"HTTP 127.0.0.1 GET http://www.unencrypted.habets.se/", "OK"},
+		{"HTTP 128.0.0.1 GET http://www.unencrypted.habets.se/", "ERR"},
+		{"NONE 127.0.0.1 CONNECT www.habets.se:443", "OK"},
+		{"NONE 127.0.0.1 CONNECT www.habets.se:8443", "ERR"},
+		{"NONE 127.0.0.2 CONNECT 9.10.0.1:443", "ERR"},
+		{"NONE 127.0.0.2 CONNECT 9.10.0.1:443 -", "ERR"},
+		{"NONE 127.0.0.2 CONNECT 9.10.0.1:443 alice", "OK"},
+
+		// Unescaped once, and '+' is not a space.
+		{"HTTP 127.0.0.3 GET http://exact.example.com/a/b%3Fx", "OK"},
+		{"HTTP 127.0.0.3 GET http://exact.example.com/a/b%253Fx", "ERR"},
+		{"HTTP 127.0.0.3 GET http://exact.example.com/a+b", "OK"},
+	} {
+		token := fmt.Sprint(n)
+		fmt.Fprintf(&in, "%s %s\n", token, test.line)
+		want[token] = test.reply
+	}
+
+	var out bytes.Buffer
+	if err := serve(&in, &out, 3, func() *policy.Config { return cfg }, make(chan struct{})); err != nil {
+		t.Fatal(err)
 	}
+	got := map[string]string{}
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		s := strings.Fields(l)
+		if len(s) < 2 {
+			t.Fatalf("Bad reply line %q", l)
+		}
+		if _, found := got[s[0]]; found {
+			t.Errorf("Duplicate reply for channel %s", s[0])
+		}
+		got[s[0]] = s[1]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got replies %v, want %v", got, want)
+	}
+}
+
+func TestPolicyGeneration(t *testing.T) {
+	before, err := policyGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE rules SET comment='changed' WHERE rule_id='ru1'`); err != nil {
+		t.Fatal(err)
+	}
+	after, err := policyGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after <= before {
+		t.Errorf("Generation didn't increase on change: before %d, after %d", before, after)
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "decisions.json")
+	decisions, err = newDecisionLogger(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { decisions = nil }()
+
+	handleLine(cfg, "7 HTTP 127.0.0.3 GET http://mail.google.com/ -")
+
+	// Rotate.
+	if err := os.Rename(fn, fn+".1"); err != nil {
+		t.Fatal(err)
+	}
+	decisions.reopen()
+	handleLine(cfg, "8 NONE 127.0.0.2 CONNECT 9.10.0.1:443 alice")
+
+	for _, test := range []struct {
+		fn   string
+		want decisionRecord
+	}{
+		{fn + ".1", decisionRecord{Channel: "7", Src: "127.0.0.3", Proto: "HTTP", Method: "GET", URI: "http://mail.google.com/", SourceID: "kid", GroupID: "kids", ACLID: "kids-web", RuleID: "kw2", Action: policy.ActionBlock}},
+		{fn, decisionRecord{Channel: "8", Src: "127.0.0.2", User: "alice", Proto: "NONE", Method: "CONNECT", URI: "9.10.0.1:443", SourceID: "alice", GroupID: "noc", ACLID: "noc-acl", RuleID: "nocrule1", Action: policy.ActionAllow}},
+	} {
+		b, err := ioutil.ReadFile(test.fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 1 {
+			t.Fatalf("%s: want 1 line, got %q", test.fn, lines)
+		}
+		var got decisionRecord
+		if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+			t.Fatalf("%s: %v", test.fn, err)
+		}
+		if got.Time.IsZero() || got.LatencyUS < 0 {
+			t.Errorf("%s: bad time or latency: %+v", test.fn, got)
+		}
+		got.Time = time.Time{}
+		got.LatencyUS = 0
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.fn, got, test.want)
+		}
+	}
+}
+
+func TestProcessFile(t *testing.T) {
+	for _, test := range []struct {
+		fn, want string
+	}{
+		{"/var/lib/node_exporter/textfile/squidwarden.prom", "/var/lib/node_exporter/textfile/squidwarden.1234.prom"},
+		{"metrics", "metrics.1234"},
+		{"/etc/squid.d/metrics", "/etc/squid.d/metrics.1234"},
+	} {
+		if got := processFile(test.fn, 1234); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.fn, got, test.want)
+		}
+	}
+}
 
-	if got, want := len(cfg.Sources), len(ss); got != want {
-		t.Fatalf("Got %d sources, want %d", got, want)
+func TestHits(t *testing.T) {
+	h := newHitCounter()
+	t1 := time.Unix(1500000000, 0)
+	t2 := time.Unix(1500000100, 0)
+	h.add("kw1", t2)
+	h.add("kw1", t1)
+	h.add("kw2", t1)
+	if err := flushAggregate(h); err != nil {
+		t.Fatal(err)
+	}
+	h.add("kw1", t1)
+	// As if the write failed.
+	b := h.take()
+	h.add("kw1", t1)
+	h.putBack(b)
+	if err := flushAggregate(h); err != nil {
+		t.Fatal(err)
+	}
+	if h.take() != nil {
+		t.Error("hits left after flush")
+	}
+	for id, want := range map[string][2]int64{
+		"kw1": {4, t2.Unix()},
+		"kw2": {1, t1.Unix()},
+	} {
+		var got [2]int64
+		if err := db.QueryRow(`SELECT hits, last_hit FROM rule_hits WHERE rule_id=?`, id).Scan(&got[0], &got[1]); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	now := time.Date(2016, 1, 4, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		d    policy.Decision
+		err  error
+		ttl  time.Duration
+		want string
+	}{
+		{
+			d:    policy.Decision{Found: true, Action: policy.ActionAllow, SourceID: "kid", GroupID: "kids", ACLID: "a1", ACLComment: `Kids "web"`, RuleID: "r1"},
+			want: ` log="source=kid group=kids acl=a1 rule=r1" message="Allowed by rule r1 in ACL \"Kids \\\"web\\\"\""`,
+		},
+		{
+			d:    policy.Decision{Found: true, Action: policy.ActionBlock, SourceID: "kid", GroupID: "kids", ACLID: "a1", RuleID: "r2", Expires: now.Add(90 * time.Second)},
+			want: ` log="source=kid group=kids acl=a1 rule=r2" message="Blocked by rule r2 in ACL \"a1\"" ttl=90`,
+		},
+		{
+			d:    policy.Decision{Action: policy.ActionBlock, Expires: now.Add(time.Hour)},
+			ttl:  time.Minute,
+			want: ` message="No rule allows this" ttl=60`,
+		},
+		{
+			d:    policy.Decision{Action: policy.ActionAllow, DefaultGroup: "staff"},
+			want: ` message="No rule matched, allowed by default for group staff"`,
+		},
+		{
+			d:    policy.Decision{Action: policy.ActionNone},
+			err:  fmt.Errorf("bad"),
+			want: ` message="Error: bad"`,
+		},
+	} {
+		*replyTTL = test.ttl
+		if got := annotations(&test.d, test.err, now); got != test.want {
+			t.Errorf("%+v: got %s, want %s", test.d, got, test.want)
+		}
+	}
+	*replyTTL = 0
+}
+
+func TestMonitor(t *testing.T) {
+	if _, err := db.Exec(`UPDATE groups SET monitor=1 WHERE group_id='kids'`); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec(`UPDATE groups SET monitor=0 WHERE group_id='kids'`)
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor = newMonitorLog()
+	defer func() { monitor = nil }()
+
+	for _, test := range []struct {
+		line, reply string
+	}{
+		{"1 HTTP 127.0.0.3 GET http://mail.google.com/a", `1 OK log="source=kid group=kids acl=kids-web rule=kw2" message="Not enforced, group kids is monitored: Blocked by rule kw2 in ACL \"kids-web\""`},
+		{"2 HTTP 127.0.0.3 GET http://mail.google.com/b", `2 OK log="source=kid group=kids acl=kids-web rule=kw2" message="Not enforced, group kids is monitored: Blocked by rule kw2 in ACL \"kids-web\""`},
+		{"3 NONE 127.0.0.3 CONNECT mail.google.com:443", `3 OK log="source=kid group=kids acl=kids-exception rule=kx1" message="Allowed by rule kx1 in ACL \"kids-exception\""`},
+		// Other groups are still enforced.
+		{"4 HTTP 128.0.0.1 GET http://www.unencrypted.habets.se/", `4 ERR message="No rule allows this"`},
+	} {
+		got := handleLine(cfg, test.line)
+		// Drop the ttl, which depends on the current time.
+		if i := strings.Index(got, " ttl="); i >= 0 {
+			got = got[:i]
+		}
+		if got != test.reply {
+			t.Errorf("%q: got %s, want %s", test.line, got, test.reply)
+		}
+	}
+	if err := flushAggregate(monitor); err != nil {
+		t.Fatal(err)
+	}
+	var site, example, reason string
+	var n int
+	if err := db.QueryRow(`SELECT site, example, reason, hits FROM monitor_log WHERE group_id='kids'`).Scan(&site, &example, &reason, &n); err != nil {
+		t.Fatal(err)
+	}
+	if site != "http://mail.google.com/" || example != "http://mail.google.com/b" || n != 2 || !strings.Contains(reason, "kw2") {
+		t.Errorf("got monitor log %q %q %q %d", site, example, reason, n)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		line, reply string
+	}{
+		{"1 HTTP 127.0.0.1", `1 BH message="want at least 4 fields, got 2"`},
+		{"2 HTTP 127.0.0.1 GET http://www.example.com/%zz", `2 BH message="field 4: invalid URL escape \"%zz\""`},
+	} {
+		if got := handleLine(cfg, test.line); got != test.reply {
+			t.Errorf("%q: got %s, want %s", test.line, got, test.reply)
+		}
+	}
+	handleLine(cfg, "3 NONE 127.0.0.3 CONNECT mail.google.com:443")
+
+	var b bytes.Buffer
+	if err := metrics.Default.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"squidwarden_helper_bad_lines_total 2\n",
+		`squidwarden_helper_decisions_total{action="allow"} `,
+		"squidwarden_helper_decision_seconds_count ",
+		"squidwarden_helper_reloads_total ",
+		"squidwarden_helper_rules ",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
 	}
-	for n, s := range ss {
-		if got, want := cfg.Sources[n].source.String(), s; got != want {
-			t.Errorf("Got %dth entry %v, want %v", n, got, want)
+	c := newDecisionCache(2)
+	now := time.Now()
+	req := func(uri string) *policy.Request {
+		return &policy.Request{Proto: "NONE", Src: "127.0.0.3", Method: "CONNECT", URI: uri, Time: now}
+	}
+	for _, test := range []struct {
+		cfg          *policy.Config
+		uri          string
+		hits, misses int64
+	}{
+		{cfg, "mail.google.com:443", 0, 1},
+		{cfg, "mail.google.com:443", 1, 1},
+		// Same once canonicalized.
+		{cfg, "MAIL.google.com.:443", 2, 1},
+		{cfg, "www.google.com:443", 2, 2},
+		{cfg, "www.habets.se:443", 2, 3},
+		// Evicted as least recently used.
+		{cfg, "mail.google.com:443", 2, 4},
+		{cfg, "www.habets.se:443", 3, 4},
+	} {
+		want, err := policy.Evaluate(test.cfg, req(test.uri))
+		if err != nil {
+			t.Fatal(err)
 		}
+		got, err := c.evaluate(test.cfg, req(test.uri))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", test.uri, got, want)
+		}
+		if c.hits != test.hits || c.misses != test.misses {
+			t.Errorf("%s: got %d hits %d misses, want %d and %d", test.uri, c.hits, c.misses, test.hits, test.misses)
+		}
+	}
+
+	// A new config empties the cache.
+	cfg2, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.evaluate(cfg2, req("www.habets.se:443")); err != nil {
+		t.Fatal(err)
+	}
+	if c.hits != 0 || c.misses != 1 || c.lru.Len() != 1 {
+		t.Errorf("after reload got %d hits %d misses %d entries, want 0, 1 and 1", c.hits, c.misses, c.lru.Len())
 	}
 }
 
-func TestDecisions(t *testing.T) {
+func TestFailsafe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*snapshotFile = path.Join(dir, "snapshot.json")
+	*statusFile = path.Join(dir, "status.json")
+	defer func() { *snapshotFile, *statusFile = "", "" }()
+
+	const line = "1 NONE 127.0.0.3 CONNECT mail.google.com:443"
 	cfg, err := loadConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
+	want := handleLine(cfg, line)
+
+	// Good database, so the snapshot is written.
+	lastSnapshot = nil
+	if cfg := startupConfig(); cfg == nil || getState() != stateOK {
+		t.Fatalf("got config %v, state %q", cfg, getState())
+	}
+
+	// Same policy again, so it's not written again.
+	moved := *snapshotFile + ".moved"
+	if err := os.Rename(*snapshotFile, moved); err != nil {
+		t.Fatal(err)
+	}
+	saveSnapshot(cfg)
+	if _, err := os.Stat(*snapshotFile); !os.IsNotExist(err) {
+		t.Errorf("snapshot of the same policy written again: %v", err)
+	}
+	if err := os.Rename(moved, *snapshotFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Database that isn't one.
+	bad := path.Join(dir, "bad.sqlite")
+	if err := ioutil.WriteFile(bad, []byte("not a database, not even close, really not at all"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	good := db
+	defer func() {
+		db = good
+		setState(stateOK, nil)
+	}()
+	if db, err = sql.Open("sqlite3", bad); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = startupConfig()
+	if cfg == nil || getState() != stateSnapshot {
+		t.Fatalf("got config %v, state %q, want snapshot", cfg, getState())
+	}
+	if got := handleLine(cfg, line); got != want {
+		t.Errorf("from snapshot got %s, want %s", got, want)
+	}
+	b, err := ioutil.ReadFile(processFile(*statusFile, os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st helperStatus
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.State != stateSnapshot || st.Error == "" {
+		t.Errorf("got status %+v", st)
+	}
+
+	// No snapshot either.
+	os.Remove(*snapshotFile)
+	if cfg := startupConfig(); cfg != nil || getState() != stateNone {
+		t.Fatalf("got config %v, state %q, want none", cfg, getState())
+	}
+	for _, test := range []struct {
+		mode, reply string
+	}{
+		{"closed", `1 ERR message="No policy loaded, failing closed"`},
+		{"open", `1 OK message="No policy loaded, failing open"`},
+	} {
+		*failMode = test.mode
+		if got := handleLine(nil, line); got != test.reply {
+			t.Errorf("%s: got %s, want %s", test.mode, got, test.reply)
+		}
+	}
+	*failMode = "closed"
+}
+
+func TestParseLine(t *testing.T) {
 	for _, test := range []struct {
-		proto, src, method, uri string
-		err                     bool
-		want                    bool
+		format, line string
+		want         requestLine
+		err          bool
 	}{
-		// domain
-		{"HTTP", "127.0.0.1", "GET", "http://www.unencrypted.habets.se/", false, true},
-		{"HTTP", "127.0.0.1", "GET", "http://www.unencrypted.habets.se:8080/", false, false},
-		{"HTTP", "128.0.0.1", "GET", "http://www.unencrypted.habets.se/", false, false},
-		{"HTTP", "127.0.0.1", "GET", "http://www.unencrypted.habets.co.uk/", false, false},
-
-		// CIDR
-		{"HTTP", "127.0.0.1", "GET", "http://9.1.2.3/blah", false, true},
-		{"HTTP", "127.0.0.1", "GET", "http://9.1.2.3:8080/blah", false, true},
-		{"HTTP", "127.0.0.1", "GET", "http://9.1.2.3:8081/blah", false, false},
-		{"HTTP", "127.0.0.1", "GET", "http://9.2.2.3/blah", false, false},
-		{"NONE", "127.0.0.1", "CONNECT", "9.2.2.3:443", false, true},
-		{"NONE", "127.0.0.1", "CONNECT", "9.2.2.3:8443", false, true},
-		{"NONE", "127.0.0.1", "CONNECT", "9.2.2.3:9443", false, false},
-		{"NONE", "127.0.0.1", "CONNECT", "9.1.2.3:443", false, false},
-
-		// Wildcard port.
-		{"HTTP", "127.0.0.1", "GET", "http://9.9.0.1/blah", false, true},
-		{"HTTP", "127.0.0.1", "GET", "http://9.9.0.1:80/blah", false, true},
-		{"HTTP", "127.0.0.1", "GET", "http://9.9.0.1:8080/blah", false, true},
-		{"NONE", "127.0.0.1", "CONNECT", "9.9.0.1", false, false}, // TODO
-		{"NONE", "127.0.0.1", "CONNECT", "9.9.0.1:443", false, true},
-		{"NONE", "127.0.0.1", "CONNECT", "9.9.0.1:8443", false, true},
-
-		// Blocked for local, not for bob.
-		// Even though bob is part of local too.
-		{"NONE", "127.0.0.1", "CONNECT", "9.10.0.1:443", false, true},
-		{"NONE", "127.0.0.2", "CONNECT", "9.10.0.1:443", false, false},
-
-		// domain for literals. Domain with missing port means port 80.
-		{"HTTP", "127.0.0.1", "GET", "http://1.2.3.4/path/blah", false, true},
-		{"HTTP", "127.0.0.1", "GET", "http://1.2.3.4:80/path/blah", false, true},
-		{"HTTP", "127.0.0.1", "GET", "http://1.2.3.4:8080/path/blah", false, false},
-		{"HTTP", "127.0.0.1", "GET", "http://1.2.3.5/path/blah", false, false},
-		{"HTTP", "127.0.0.1", "GET", "http://1.2.3.5:80/path/blah", false, false},
-		{"HTTP", "127.0.0.1", "GET", "http://1.2.3.5:8080/path/blah", false, true},
-
-		// regex
-		{"HTTP", "127.0.0.1", "GET", "http://www.google.co.uk/url?foo=bar", false, true},
-		{"HTTP", "127.0.0.1", "GET", "http://www.google.co.uk/", false, false},
-
-		// https-domain
-		{"NONE", "127.0.0.1", "CONNECT", "www.habets.se:443", false, true},
-		{"NONE", "127.0.0.1", "CONNECT", "www.habets.se:8443", false, false},
-		{"NONE", "127.0.0.1", "CONNECT", "www.habets.co.uk:443", false, false},
-		{"NONE", "127.0.0.1", "CONNECT", "www.port.com:443", false, false},
-		{"NONE", "127.0.0.1", "CONNECT", "www.port.com:8443", false, true},
-		{"NONE", "127.0.0.1", "CONNECT", "www.github.com:443", false, false},
-		{"NONE", "127.0.0.1", "CONNECT", "github.com:443", false, true},
-
-		// IPv6 mask
-		{"HTTP", "2001:db8::1234:5678", "GET", "http://www.unencrypted.habets.se/", false, true},
-		{"HTTP", "2001:db8::1234:5679", "GET", "http://www.unencrypted.habets.se/", false, false},
-
-		// IPv4 mask
-		{"HTTP", "129.99.0.1", "GET", "http://www.unencrypted.habets.se/", false, true},
-		{"HTTP", "129.99.99.1", "GET", "http://www.unencrypted.habets.se/", false, true},
-		{"HTTP", "129.99.0.2", "GET", "http://www.unencrypted.habets.se/", false, false},
-		{"HTTP", "129.99.99.2", "GET", "http://www.unencrypted.habets.se/", false, false},
+		{defaultFormat, "1 HTTP 10.0.0.1 GET http://a/", requestLine{Channel: "1", Proto: "HTTP", Src: "10.0.0.1", Method: "GET", URI: "http://a/"}, false},
+		{defaultFormat, "2 NONE 10.0.0.1 CONNECT a:443 alice", requestLine{Channel: "2", Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: "a:443", User: "alice"}, false},
+		{defaultFormat, "3 HTTP 10.0.0.1 GET http://a/%20b+c -", requestLine{Channel: "3", Proto: "HTTP", Src: "10.0.0.1", Method: "GET", URI: "http://a/ b+c"}, false},
+		{defaultFormat, "4 - 10.0.0.1 CONNECT a:443", requestLine{Channel: "4", Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: "a:443"}, false},
+		{defaultFormat, "5 HTTP 10.0.0.1 GET http://a/ bob%40example.com kids ex%20tra", requestLine{Channel: "5", Proto: "HTTP", Src: "10.0.0.1", Method: "GET", URI: "http://a/", User: "bob@example.com", Extra: []string{"kids", "ex tra"}}, false},
+		{defaultFormat, "6  HTTP 10.0.0.1 GET http://a/\r", requestLine{Channel: "6", Proto: "HTTP", Src: "10.0.0.1", Method: "GET", URI: "http://a/"}, false},
+		{"%SRC %URI %METHOD %un", "7 10.0.0.1 http://a/ GET carol", requestLine{Channel: "7", Proto: "HTTP", Src: "10.0.0.1", Method: "GET", URI: "http://a/", User: "carol"}, false},
+		{"%>a %DST %rm %ru", "8 10.0.0.1 10.9.9.9 CONNECT a:443", requestLine{Channel: "8", Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: "a:443"}, false},
+		{"%SRC %METHOD %URI %ssl::>sni %ssl::<cert_subject", "9 10.0.0.1 CONNECT 192.0.2.1:443 a /C=US/O=Example/CN=%2A.a", requestLine{Channel: "9", Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: "192.0.2.1:443", SNI: "a", CertNames: []string{"*.a"}}, false},
+		{"%SRC %METHOD %URI %ssl::>sni %ssl::<cert", "10 10.0.0.1 CONNECT 192.0.2.1:443 - -", requestLine{Channel: "10", Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: "192.0.2.1:443"}, false},
+
+		{defaultFormat, "", requestLine{}, true},
+		{defaultFormat, "x HTTP 10.0.0.1 GET http://a/", requestLine{}, true},
+		{defaultFormat, "9 HTTP 10.0.0.1", requestLine{Channel: "9"}, true},
+		{defaultFormat, "10 HTTP - GET http://a/", requestLine{Channel: "10"}, true},
+		{defaultFormat, "11 HTTP 10.0.0.1 GET http://a/%zz", requestLine{Channel: "11"}, true},
+		{defaultFormat, "12 HTTP 10.0.0.1 GET http://a/ - %", requestLine{Channel: "12"}, true},
 	} {
-		v, action, err := decide(cfg, test.proto, test.src, test.method, test.uri)
-		if action == actionIgnore {
-			v = false
-		}
-		if err != nil != test.err {
-			t.Errorf("Want err %v, got %v for %+v", test.err, err, test)
-		} else {
-			if v != test.want {
-				t.Errorf("Wrong results %t (want %t) for %+v", v, test.want, test)
+		f, err := parseFormat(test.format)
+		if err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+		got, err := f.parse(test.line)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v, want error %t", test.line, err, test.err)
+		}
+		if test.err {
+			if got.Channel != test.want.Channel {
+				t.Errorf("%q: got channel %q, want %q", test.line, got.Channel, test.want.Channel)
 			}
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.line, got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"", "%SRC %URI", "%SRC %SRC %METHOD %URI", "SRC %METHOD %URI", "%>a %LOGIN %rm %ru %EXT_USER", "%SRC %METHOD %URI %ssl::>sni %ssl::>sni"} {
+		if _, err := parseFormat(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestTLSNames(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "blog.habets.se"},
+		DNSNames:     []string{"blog.habets.se", "*.cdn.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if got, want := certNames(cert), []string{"blog.habets.se", "*.cdn.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("certNames: got %q, want %q", got, want)
+	}
+	if got := certNames("garbage"); got != nil {
+		t.Errorf("certNames of garbage: got %q", got)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f *lineFormat) { inputFormat = f }(inputFormat)
+	inputFormat, err = parseFormat("%SRC %METHOD %URI %ssl::>sni %ssl::<cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		line  string
+		reply string
+	}{
+		// Allowed by the https-domain rule on the SNI.
+		{"1 127.0.0.5 CONNECT 192.0.2.1:443 blog.habets.se -", "1 OK"},
+		{"2 127.0.0.5 CONNECT 192.0.2.1:443 - -", "2 ERR"},
+		{"3 127.0.0.5 CONNECT 192.0.2.1:443 - " + encodeField(cert), "3 ERR"},
+		// A spoofed SNI doesn't get a named host allowed.
+		{"4 127.0.0.5 CONNECT evil.example.net:443 www.habets.se " + encodeField(cert), "4 ERR"},
+	} {
+		if got := handleLine(cfg, test.line); !strings.HasPrefix(got, test.reply+" ") {
+			t.Errorf("%q: got %s, want %s", test.line, got, test.reply)
 		}
 	}
 }
+
+// encodeField encodes a field as squid would.
+func encodeField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	if s == "-" {
+		return "%2D"
+	}
+	return url.PathEscape(s)
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, s := range []string{
+		"1 HTTP 10.0.0.1 GET http://a/",
+		"2 NONE 10.0.0.1 CONNECT a:443 alice",
+		"3 HTTP 10.0.0.1 GET http://a/%20b+c -",
+		"5 HTTP 10.0.0.1 GET http://a/ bob%40example.com kids ex%20tra",
+		"9 HTTP 10.0.0.1",
+		"11 HTTP 10.0.0.1 GET http://a/%zz",
+		"12 - 127.0.0.3 - cache_object://a/",
+		"",
+	} {
+		f.Add(s)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		f.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldVerbose, oldBlockLog := *verbose, *blockLog
+	*verbose, *blockLog = 0, path.Join(dir, "block.log")
+	defer func() { *verbose, *blockLog = oldVerbose, oldBlockLog }()
+
+	f.Fuzz(func(t *testing.T, line string) {
+		r, err := inputFormat.parse(line)
+		reply := handleLine(cfg, line)
+		if strings.ContainsAny(reply, "\r\n") {
+			t.Fatalf("%q: reply %q has a newline", line, reply)
+		}
+		s := strings.SplitN(reply, " ", 3)
+		if r.Channel != "" {
+			if s[0] != r.Channel {
+				t.Fatalf("%q: reply %q not on channel %q", line, reply, r.Channel)
+			}
+			s = s[1:]
+		}
+		if err != nil {
+			if s[0] != "BH" {
+				t.Fatalf("%q: got %q for a bad line", line, reply)
+			}
+			return
+		}
+		if s[0] != aclMatch && s[0] != aclNoMatch {
+			t.Fatalf("%q: got %q for a good line", line, reply)
+		}
+
+		// Encoding it again gives the same request.
+		l := []string{r.Channel}
+		for _, v := range []string{r.Proto, r.Src, r.Method, r.URI, r.User} {
+			l = append(l, encodeField(v))
+		}
+		for _, v := range r.Extra {
+			l = append(l, encodeField(v))
+		}
+		r2, err := inputFormat.parse(strings.Join(l, " "))
+		if err != nil {
+			t.Fatalf("%q: re-encoded as %q: %v", line, strings.Join(l, " "), err)
+		}
+		if !reflect.DeepEqual(r, r2) {
+			t.Fatalf("%q: got %+v, re-encoded %+v", line, r, r2)
+		}
+	})
+}
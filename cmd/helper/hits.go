@@ -0,0 +1,100 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Per-rule hit counters, aggregated in memory and flushed to the database now
+// and then, so that the UI can show which rules are still in use.
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+type ruleHits struct {
+	n    int64
+	last time.Time
+}
+
+// hitCounter counts rule hits since the last flush.
+type hitCounter struct {
+	m    sync.Mutex
+	hits map[string]*ruleHits
+}
+
+func newHitCounter() *hitCounter {
+	return &hitCounter{hits: make(map[string]*ruleHits)}
+}
+
+// add records a hit on a rule at time t.
+func (h *hitCounter) add(ruleID string, t time.Time) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	e := h.hits[ruleID]
+	if e == nil {
+		e = &ruleHits{}
+		h.hits[ruleID] = e
+	}
+	e.n++
+	if t.After(e.last) {
+		e.last = t
+	}
+}
+
+// hitBatch is rule hits taken from a hitCounter, by rule ID.
+type hitBatch map[string]*ruleHits
+
+// take implements aggregate.
+func (h *hitCounter) take() batch {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if len(h.hits) == 0 {
+		return nil
+	}
+	hits := h.hits
+	h.hits = make(map[string]*ruleHits)
+	return hitBatch(hits)
+}
+
+// putBack implements aggregate, adding the counts to those since taken.
+func (h *hitCounter) putBack(b batch) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for id, e := range b.(hitBatch) {
+		o := h.hits[id]
+		if o == nil {
+			h.hits[id] = e
+			continue
+		}
+		o.n += e.n
+		if e.last.After(o.last) {
+			o.last = e.last
+		}
+	}
+}
+
+// write implements batch, adding the hits to the rule_hits table.
+func (hits hitBatch) write(tx *sql.Tx) error {
+	for id, e := range hits {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO rule_hits(rule_id, hits) VALUES(?, 0)`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE rule_hits SET hits=hits+?, last_hit=max(coalesce(last_hit, 0), ?) WHERE rule_id=?`, e.n, e.last.Unix(), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
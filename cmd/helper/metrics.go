@@ -0,0 +1,77 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Operational metrics, served over HTTP or written to a file for the node
+// exporter's textfile collector, since squid owns stdin and stdout.
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/squidwarden/metrics"
+)
+
+var (
+	decisionsTotal  = metrics.NewCounter("squidwarden_helper_decisions_total", "Decisions made, by action.", "action")
+	decisionSeconds = metrics.NewHistogram("squidwarden_helper_decision_seconds", "Time spent evaluating a request.", metrics.LatencyBuckets)
+	badLines        = metrics.NewCounter("squidwarden_helper_bad_lines_total", "Request lines from squid that couldn't be parsed.")
+	cacheHits       = metrics.NewCounter("squidwarden_helper_cache_hits_total", "Decisions found in the decision cache.")
+	cacheMisses     = metrics.NewCounter("squidwarden_helper_cache_misses_total", "Decisions not found in the decision cache.")
+	cacheEntries    = metrics.NewGauge("squidwarden_helper_cache_entries", "Decisions in the decision cache.")
+
+	reloadsTotal   = metrics.NewCounter("squidwarden_helper_reloads_total", "Policy loads, including the first.")
+	reloadFailures = metrics.NewCounter("squidwarden_helper_reload_failures_total", "Policy loads that failed.")
+	reloadSeconds  = metrics.NewHistogram("squidwarden_helper_reload_seconds", "Time spent loading the policy.", metrics.LatencyBuckets)
+	ruleCount      = metrics.NewGauge("squidwarden_helper_rules", "Rules in the loaded policy.")
+
+	policyStateGauge = metrics.NewGauge("squidwarden_helper_policy_state", "1 for what the helper decides from: ok for the database, stale or snapshot if that failed, none if there's no policy.", "state")
+)
+
+// serveMetrics serves metrics on addr until the helper exits. Squid gives
+// every helper process the same flags, so only the first one to start gets
+// the address, and the others just log that they don't serve.
+func serveMetrics(addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Not serving metrics: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	log.Printf("Serving metrics on %s", addr)
+	if err := http.Serve(l, mux); err != nil {
+		log.Printf("Metrics listener failed: %v", err)
+	}
+}
+
+// metricsWriter writes metrics to fn every interval until stop is closed.
+func metricsWriter(fn string, interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := metrics.Default.WriteFile(fn); err != nil {
+				log.Printf("Failed to write metrics: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Requests that monitored groups would have had blocked, aggregated per group
+// and site in memory and flushed to the database now and then, so that the UI
+// can propose an ACL from them.
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type monitorKey struct {
+	group string
+	site  string
+}
+
+type monitorEntry struct {
+	n       int64
+	first   time.Time
+	last    time.Time
+	example string
+	reason  string
+}
+
+// monitorLog collects monitored blocks since the last flush.
+type monitorLog struct {
+	m       sync.Mutex
+	entries map[monitorKey]*monitorEntry
+}
+
+func newMonitorLog() *monitorLog {
+	return &monitorLog{entries: make(map[monitorKey]*monitorEntry)}
+}
+
+// monitorSite returns what monitored blocks are aggregated by: host:port for
+// CONNECT, or the URL up to the path.
+func monitorSite(method, uri string) string {
+	if method == "CONNECT" {
+		return strings.ToLower(uri)
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return uri
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host + "/")
+}
+
+// add records a request to uri that group would have had blocked at time t.
+func (l *monitorLog) add(group, site, uri, reason string, t time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	k := monitorKey{group: group, site: site}
+	e := l.entries[k]
+	if e == nil {
+		e = &monitorEntry{first: t}
+		l.entries[k] = e
+	}
+	e.n++
+	if t.Before(e.first) {
+		e.first = t
+	}
+	if !t.Before(e.last) {
+		e.last = t
+		e.example = uri
+		e.reason = reason
+	}
+}
+
+// monitorBatch is entries taken from a monitorLog.
+type monitorBatch map[monitorKey]*monitorEntry
+
+// take implements aggregate.
+func (l *monitorLog) take() batch {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if len(l.entries) == 0 {
+		return nil
+	}
+	entries := l.entries
+	l.entries = make(map[monitorKey]*monitorEntry)
+	return monitorBatch(entries)
+}
+
+// putBack implements aggregate, merging the entries with those since taken
+// and keeping the latest example.
+func (l *monitorLog) putBack(b batch) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for k, e := range b.(monitorBatch) {
+		o := l.entries[k]
+		if o == nil {
+			l.entries[k] = e
+			continue
+		}
+		o.n += e.n
+		if e.first.Before(o.first) {
+			o.first = e.first
+		}
+		if e.last.After(o.last) {
+			o.last, o.example, o.reason = e.last, e.example, e.reason
+		}
+	}
+}
+
+// write implements batch, adding the entries to the monitor_log table.
+func (entries monitorBatch) write(tx *sql.Tx) error {
+	for k, e := range entries {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO monitor_log(group_id, site, example, reason, hits, first_hit, last_hit) VALUES(?, ?, ?, ?, 0, ?, ?)`,
+			k.group, k.site, e.example, e.reason, e.first.Unix(), e.last.Unix()); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+UPDATE monitor_log
+SET hits=hits+?,
+    first_hit=min(first_hit, ?),
+    example=CASE WHEN ? >= last_hit THEN ? ELSE example END,
+    reason=CASE WHEN ? >= last_hit THEN ? ELSE reason END,
+    last_hit=max(last_hit, ?)
+WHERE group_id=? AND site=?`,
+			e.n, e.first.Unix(), e.last.Unix(), e.example, e.last.Unix(), e.reason, e.last.Unix(), k.group, k.site); err != nil {
+			return err
+		}
+	}
+	return nil
+}
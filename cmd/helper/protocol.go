@@ -0,0 +1,251 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Parsing request lines from squid. A line is the channel ID, then the fields
+// of the external_acl_type format, then any arguments from the acl line, all
+// space separated and %-encoded, with "-" for values squid doesn't have.
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const defaultFormat = "%PROTO %SRC %METHOD %URI %LOGIN"
+
+// Fields the helper uses. Other format codes are accepted and skipped.
+const (
+	fieldOther = iota
+	fieldProto
+	fieldSrc
+	fieldMethod
+	fieldURI
+	fieldUser
+	fieldSNI
+	fieldCertSubject
+	fieldCert
+)
+
+// formatFields maps format codes, old style and logformat, to fields.
+var formatFields = map[string]int{
+	"%PROTO":    fieldProto,
+	"%SRC":      fieldSrc,
+	"%>a":       fieldSrc,
+	"%METHOD":   fieldMethod,
+	"%rm":       fieldMethod,
+	"%URI":      fieldURI,
+	"%ru":       fieldURI,
+	"%>ru":      fieldURI,
+	"%LOGIN":    fieldUser,
+	"%EXT_USER": fieldUser,
+	"%un":       fieldUser,
+	"%ul":       fieldUser,
+	"%ue":       fieldUser,
+
+	// With ssl_bump peek or stare.
+	"%ssl::>sni":          fieldSNI,
+	"%ssl::<cert_subject": fieldCertSubject,
+	"%ssl::<cert":         fieldCert,
+}
+
+// inputFormat is the format of request lines, from -format.
+var inputFormat, _ = parseFormat(defaultFormat)
+
+// lineFormat is the order of fields in request lines.
+type lineFormat struct {
+	fields []int
+
+	// Fields up to this one must be present. Later ones may be left out,
+	// as a user field used to be.
+	required int
+}
+
+// parseFormat parses a format as in the external_acl_type line, e.g.
+// "%PROTO %SRC %METHOD %URI %LOGIN".
+func parseFormat(s string) (*lineFormat, error) {
+	f := &lineFormat{}
+	seen := make(map[int]bool)
+	for _, c := range strings.Fields(s) {
+		if !strings.HasPrefix(c, "%") {
+			return nil, fmt.Errorf("format code %q doesn't start with %%", c)
+		}
+		fl := formatFields[c]
+		if fl != fieldOther {
+			if seen[fl] {
+				return nil, fmt.Errorf("format code %q repeats a field", c)
+			}
+			seen[fl] = true
+		}
+		f.fields = append(f.fields, fl)
+		if fl == fieldSrc || fl == fieldMethod || fl == fieldURI {
+			f.required = len(f.fields)
+		}
+	}
+	for _, fl := range []int{fieldSrc, fieldMethod, fieldURI} {
+		if !seen[fl] {
+			return nil, fmt.Errorf("format %q lacks the source, method or URI", s)
+		}
+	}
+	return f, nil
+}
+
+// requestLine is a parsed request line, with fields decoded.
+type requestLine struct {
+	Channel string
+	Proto   string
+	Src     string
+	Method  string
+	URI     string
+	User    string
+
+	// From the TLS handshake: the client's SNI, and the names the server
+	// certificate is for.
+	SNI       string
+	CertNames []string
+
+	// Arguments from the acl line, after the format fields.
+	Extra []string
+}
+
+// decodeField undoes squid's %-encoding of a field. Not as a query, since '+'
+// means '+'.
+func decodeField(s string) (string, error) {
+	if s == "-" {
+		return "", nil
+	}
+	return url.PathUnescape(s)
+}
+
+// parse parses a request line. On error the channel is still set if there
+// was one, so that the error can be replied on it.
+func (f *lineFormat) parse(line string) (requestLine, error) {
+	var r requestLine
+	s := strings.Fields(line)
+	if len(s) == 0 {
+		return r, fmt.Errorf("empty line")
+	}
+	r.Channel = s[0]
+	for _, c := range r.Channel {
+		if c < '0' || c > '9' {
+			r.Channel = ""
+			return r, fmt.Errorf("bad channel ID %q", s[0])
+		}
+	}
+	s = s[1:]
+	if len(s) < f.required {
+		return r, fmt.Errorf("want at least %d fields, got %d", f.required, len(s))
+	}
+	for i, fl := range f.fields {
+		if i >= len(s) {
+			break
+		}
+		v, err := decodeField(s[i])
+		if err != nil {
+			return r, fmt.Errorf("field %d: %v", i+1, err)
+		}
+		switch fl {
+		case fieldProto:
+			r.Proto = v
+		case fieldSrc:
+			r.Src = v
+		case fieldMethod:
+			r.Method = v
+		case fieldURI:
+			r.URI = v
+		case fieldUser:
+			r.User = v
+		case fieldSNI:
+			r.SNI = v
+		case fieldCertSubject:
+			r.CertNames = append(r.CertNames, subjectNames(v)...)
+		case fieldCert:
+			r.CertNames = append(r.CertNames, certNames(v)...)
+		}
+	}
+	if len(s) > len(f.fields) {
+		for _, e := range s[len(f.fields):] {
+			v, err := decodeField(e)
+			if err != nil {
+				return r, fmt.Errorf("acl argument %q: %v", e, err)
+			}
+			r.Extra = append(r.Extra, v)
+		}
+	}
+	switch {
+	case r.Src == "":
+		return r, fmt.Errorf("no source address")
+	case r.Method == "":
+		return r, fmt.Errorf("no method")
+	case r.URI == "":
+		return r, fmt.Errorf("no URI")
+	}
+	if r.Proto == "" {
+		// What squid would have sent.
+		r.Proto = "HTTP"
+		if r.Method == "CONNECT" {
+			r.Proto = "NONE"
+		}
+	}
+	return r, nil
+}
+
+// subjectNames returns the common names in a certificate subject as squid
+// formats it, e.g. "/C=US/O=Example/CN=www.example.com".
+func subjectNames(subject string) []string {
+	var ret []string
+	for _, p := range strings.Split(subject, "/") {
+		if strings.HasPrefix(p, "CN=") && len(p) > 3 {
+			ret = append(ret, p[3:])
+		}
+	}
+	return ret
+}
+
+// certNames returns the common name and DNS subject alternative names of a
+// PEM certificate. A certificate that can't be parsed has no names, so that
+// rules on them don't match, but others still do.
+func certNames(s string) []string {
+	b, _ := pem.Decode([]byte(s))
+	if b == nil {
+		return nil
+	}
+	c, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return nil
+	}
+	var ret []string
+	if c.Subject.CommonName != "" {
+		ret = append(ret, c.Subject.CommonName)
+	}
+	for _, n := range c.DNSNames {
+		if n != c.Subject.CommonName {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// badReply is the reply to a line that couldn't be parsed.
+func badReply(channel string, err error) string {
+	reply := fmt.Sprintf("BH message=%s", kvQuote(err.Error()))
+	if channel == "" {
+		return reply
+	}
+	return channel + " " + reply
+}
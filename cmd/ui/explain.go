@@ -0,0 +1,110 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Explaining what the helper would decide for a request, and why, using the
+// same policy code as the helper.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/policy"
+)
+
+// explainRequest builds a request from what the user entered. The proto is
+// what squid would send if not given.
+func explainRequest(proto, src, method, uri, user string) *policy.Request {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if method == "" {
+		method = "GET"
+	}
+	proto = strings.ToUpper(strings.TrimSpace(proto))
+	if proto == "" {
+		proto = "HTTP"
+		if method == "CONNECT" {
+			proto = "NONE"
+		}
+	}
+	return &policy.Request{
+		Proto:  proto,
+		Src:    strings.TrimSpace(src),
+		Method: method,
+		URI:    strings.TrimSpace(uri),
+		User:   strings.TrimSpace(user),
+		Time:   time.Now(),
+	}
+}
+
+func explainHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		// As entered, so that an empty one stays empty.
+		Proto string
+
+		Request  *policy.Request
+		Decision policy.Decision
+		Trace    *policy.Trace
+		Error    string
+	}{
+		Proto:   r.FormValue("proto"),
+		Request: explainRequest(r.FormValue("proto"), r.FormValue("src"), r.FormValue("method"), r.FormValue("uri"), r.FormValue("user")),
+	}
+	data.Request.SNI = strings.TrimSpace(r.FormValue("sni"))
+	data.Request.CertNames = strings.Fields(strings.Replace(r.FormValue("cert_names"), ",", " ", -1))
+	if data.Request.Src != "" && data.Request.URI != "" {
+		cfg, err := policy.Load(db)
+		if err != nil {
+			return "", err
+		}
+		// Bad input is shown on the page rather than as an error page.
+		if data.Decision, data.Trace, err = policy.Explain(cfg, data.Request); err != nil {
+			data.Error = err.Error()
+		}
+	}
+
+	tmpl := getTemplate("explain.html", template.FuncMap{"join": strings.Join})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// explainMain is the explain subcommand, printing the trace for a request.
+func explainMain(args []string) error {
+	if len(args) < 4 || len(args) > 5 {
+		return fmt.Errorf("usage: %s [flags] explain <proto> <src> <method> <uri> [user]", os.Args[0])
+	}
+	user := ""
+	if len(args) == 5 {
+		user = args[4]
+	}
+	openDB()
+	cfg, err := policy.Load(db)
+	if err != nil {
+		return fmt.Errorf("failed to load policy: %v", err)
+	}
+	d, t, err := policy.Explain(cfg, explainRequest(args[0], args[1], args[2], args[3], user))
+	if err != nil {
+		return err
+	}
+	return t.Write(os.Stdout, d)
+}
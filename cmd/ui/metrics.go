@@ -0,0 +1,60 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/metrics"
+)
+
+var (
+	uiRequests       = metrics.NewCounter("squidwarden_ui_requests_total", "HTTP requests, by route and status code.", "route", "code")
+	uiRequestSeconds = metrics.NewHistogram("squidwarden_ui_request_seconds", "Time spent serving HTTP requests, by route.", metrics.LatencyBuckets, "route")
+	tailWebsockets   = metrics.NewGauge("squidwarden_ui_tail_websockets", "Open websockets tailing the log.")
+)
+
+// statusRecorder remembers the status code written.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// routeName is the route as a metric label, without the ID regexps.
+func routeName(p string) string {
+	return strings.Replace(p, ":"+uuidRE, "", -1)
+}
+
+// countRoute wraps a handler to count its requests and their latency. Not
+// for websockets, since the recorder can't be hijacked.
+func countRoute(route string, h http.Handler) http.Handler {
+	route = routeName(route)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		uiRequests.Inc(route, strconv.Itoa(rec.code))
+		uiRequestSeconds.Observe(time.Since(st).Seconds(), route)
+	})
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Monitored groups have their blocks logged by the helper instead of enforced.
+// Here the log is turned into a proposed ACL for the group.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+// monitorEntry is a site a monitored group would have had blocked.
+type monitorEntry struct {
+	Site     string
+	Example  string
+	Reason   string
+	Hits     int64
+	FirstHit string
+	LastHit  string
+
+	// Rule proposed to allow the site.
+	Type  string
+	Value string
+}
+
+func getMonitorLog(g groupID) ([]monitorEntry, error) {
+	rows, err := db.Query(`
+SELECT site, example, reason, hits, first_hit, last_hit
+FROM monitor_log
+WHERE group_id=?
+ORDER BY hits DESC, site`, string(g))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []monitorEntry
+	for rows.Next() {
+		var e monitorEntry
+		var first, last int64
+		if err := rows.Scan(&e.Site, &e.Example, &e.Reason, &e.Hits, &first, &last); err != nil {
+			return nil, err
+		}
+		e.FirstHit = time.Unix(first, 0).UTC().Format(saneTime)
+		e.LastHit = time.Unix(last, 0).UTC().Format(saneTime)
+		e.Type, e.Value = suggestRule(e.Site)
+		ret = append(ret, e)
+	}
+	return ret, rows.Err()
+}
+
+func monitorHandler(r *http.Request) (template.HTML, error) {
+	current := groupID(mux.Vars(r)["groupID"])
+	data := struct {
+		Groups  []group
+		Current group
+		Entries []monitorEntry
+		Types   []string
+	}{
+		Types: []string{typeDomain, typeHTTPSDomain, typeRegex, typeHTTPSRegex, typeExact, typePathPrefix, typeHostGlob, typeSNI, typeCertName},
+	}
+	var err error
+	if data.Groups, data.Current, err = getGroups(current); err != nil {
+		return "", fmt.Errorf("getGroups: %v", err)
+	}
+	if current != "" {
+		if data.Entries, err = getMonitorLog(current); err != nil {
+			return "", err
+		}
+	}
+
+	tmpl := getTemplate("monitor.html", template.FuncMap{"groupIDEQ": func(a, b groupID) bool { return a == b }})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// groupMonitorHandler switches a group between monitoring and enforcing.
+func groupMonitorHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	on := r.FormValue("monitor") == "true"
+	log.Printf("Setting monitor of group %s to %t", id, on)
+	return "OK", txWrap(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE groups SET monitor=? WHERE group_id=?`, on, string(id))
+		return err
+	})
+}
+
+// monitorACLHandler creates an ACL allowing the given sites, grants it to the
+// group, and removes the sites from the log. The ACL can then be reviewed
+// before the group is switched to enforcing.
+func monitorACLHandler(r *http.Request) (interface{}, error) {
+	g := assertGroupID(mux.Vars(r)["groupID"])
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	sites := r.Form["sites[]"]
+	types := r.Form["types[]"]
+	values := r.Form["values[]"]
+	if len(sites) == 0 || len(types) != len(sites) || len(values) != len(sites) {
+		return nil, errHTTP{
+			external: "no sites selected, or lists of different length",
+			code:     http.StatusBadRequest,
+		}
+	}
+	for n := range values {
+		values[n] = strings.TrimSpace(values[n])
+		if err := validateRule(types[n], values[n]); err != nil {
+			return nil, err
+		}
+	}
+	var c sql.NullString
+	if err := db.QueryRow(`SELECT comment FROM groups WHERE group_id=?`, string(g)).Scan(&c); err == sql.ErrNoRows {
+		return nil, errHTTP{
+			external: "group not found",
+			code:     http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	name := c.String
+	if name == "" {
+		name = string(g)
+	}
+
+	acl := uuid.NewV4().String()
+	resp := struct {
+		ACL string `json:"acl"`
+	}{ACL: acl}
+	log.Printf("Creating ACL %s with %d rules from the monitor log of group %s", acl, len(sites), g)
+	return &resp, txWrap(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?,?)`, acl, "Proposed for "+name); err != nil {
+			return err
+		}
+		for n := range sites {
+			if _, err := addRule(tx, aclID(acl), types[n], values[n], actionAllow, "Seen while monitoring "+name); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM monitor_log WHERE group_id=? AND site=?`, string(g), sites[n]); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`INSERT INTO groupaccess(group_id, acl_id) VALUES(?,?)`, string(g), acl)
+		return err
+	})
+}
+
+func monitorClearHandler(r *http.Request) (interface{}, error) {
+	g := assertGroupID(mux.Vars(r)["groupID"])
+	log.Printf("Clearing monitor log of group %s", g)
+	return "OK", txWrap(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM monitor_log WHERE group_id=?`, string(g))
+		return err
+	})
+}
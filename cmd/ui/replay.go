@@ -0,0 +1,453 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Replaying logged requests against a candidate policy, to see what a change
+// would break before making it.
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/squidwarden/policy"
+)
+
+const (
+	// Longest log line to read. Longer ones are counted as bad.
+	maxReplayLine = 1 << 20
+
+	// How many bad lines to report.
+	maxReplayErrors = 10
+)
+
+// replayFlip is requests from one client to one domain whose outcome changes
+// the same way. Outcomes are as from replayOutcome.
+type replayFlip struct {
+	Client  string
+	Domain  string
+	From    string
+	To      string
+	Count   int
+	Example string
+}
+
+// replayReport is the outcome of a replay.
+type replayReport struct {
+	Lines    int
+	Replayed int
+	Flipped  int
+	Flips    []replayFlip
+
+	// Line numbers of lines that couldn't be parsed, and why. Only the
+	// first few are kept.
+	Bad    int
+	Errors []string
+}
+
+// parseReplayLine parses a line of a squid access log in native format, such
+// as the block log, or of the helper decision log. Errors don't quote the
+// line, since they're shown in the UI.
+func parseReplayLine(l string) (*policy.Request, error) {
+	if strings.HasPrefix(l, "{") {
+		var e struct {
+			Time   time.Time `json:"time"`
+			Src    string    `json:"src"`
+			User   string    `json:"user"`
+			Proto  string    `json:"proto"`
+			Method string    `json:"method"`
+			URI    string    `json:"uri"`
+
+			SNI       string   `json:"sni"`
+			CertNames []string `json:"cert_names"`
+		}
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			return nil, fmt.Errorf("bad decision log line")
+		}
+		return &policy.Request{Proto: e.Proto, Src: e.Src, Method: e.Method, URI: e.URI, User: e.User, SNI: e.SNI, CertNames: e.CertNames, Time: e.Time}, nil
+	}
+	e, err := parseLogEntry(l)
+	if err != nil {
+		return nil, fmt.Errorf("bad squid log line")
+	}
+	// Squid only logs the method, so assume it's what squid would send.
+	proto := "HTTP"
+	if e.Method == "CONNECT" {
+		proto = "NONE"
+	}
+	return &policy.Request{Proto: proto, Src: e.Client, Method: e.Method, URI: e.URL, User: e.User, Time: e.t}, nil
+}
+
+// requestDomain returns the domain a request is for, as shown in the log.
+func requestDomain(req *policy.Request) string {
+	if req.Method == "CONNECT" {
+		if h, port, err := net.SplitHostPort(req.URI); err == nil && port == "443" {
+			return host2domain(h)
+		}
+		return host2domain(req.URI)
+	}
+	if u, err := url.Parse(req.URI); err == nil && u.Host != "" {
+		return host2domain(u.Host)
+	}
+	return req.URI
+}
+
+// replayOutcome describes what the helper does with a request: the action,
+// marked as monitored if a monitored group means the helper lets it through
+// anyway, as it does for errors too.
+func replayOutcome(d policy.Decision, err error) string {
+	if err != nil {
+		return string(policy.ActionNone)
+	}
+	if d.Monitor && (d.Action == policy.ActionBlock || d.Action == policy.ActionNone) {
+		return string(d.Action) + " (monitored)"
+	}
+	return string(d.Action)
+}
+
+// replayPolicy is a policy compiled as of the requests replayed, so that
+// rules, grants and memberships are in effect as they were then. Logs are in
+// order, so it's only compiled again when one of those changes.
+type replayPolicy struct {
+	base *policy.Config
+	cfg  *policy.Config
+	from time.Time // When cfg was compiled as of.
+}
+
+// at returns the policy as of t.
+func (p *replayPolicy) at(t time.Time) (*policy.Config, error) {
+	if p.cfg != nil && !t.Before(p.from) && (p.cfg.Changes.IsZero() || t.Before(p.cfg.Changes)) {
+		return p.cfg, nil
+	}
+	c, err := p.base.CompileAt(t)
+	if err != nil {
+		return nil, err
+	}
+	p.cfg, p.from = c, t
+	return c, nil
+}
+
+// replay evaluates every logged request against the current and candidate
+// policies, and reports those whose outcome differs. Requests are evaluated at
+// the time they were logged, so validity and schedules apply as they did then.
+func replay(r io.Reader, current, candidate *policy.Config) (*replayReport, error) {
+	rep := &replayReport{}
+	cur := &replayPolicy{base: current}
+	cand := &replayPolicy{base: candidate}
+	flips := make(map[replayFlip]*replayFlip)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxReplayLine)
+	for scanner.Scan() {
+		rep.Lines++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" {
+			continue
+		}
+		req, err := parseReplayLine(l)
+		if err != nil {
+			rep.Bad++
+			if len(rep.Errors) < maxReplayErrors {
+				rep.Errors = append(rep.Errors, fmt.Sprintf("line %d: %v", rep.Lines, err))
+			}
+			continue
+		}
+		rep.Replayed++
+
+		curCfg, err := cur.at(req.Time)
+		if err != nil {
+			return nil, err
+		}
+		candCfg, err := cand.at(req.Time)
+		if err != nil {
+			return nil, err
+		}
+		from := replayOutcome(policy.Evaluate(curCfg, req))
+		to := replayOutcome(policy.Evaluate(candCfg, req))
+		if from == to {
+			continue
+		}
+		rep.Flipped++
+		k := replayFlip{
+			Client: req.Src,
+			Domain: requestDomain(req),
+			From:   from,
+			To:     to,
+		}
+		f := flips[k]
+		if f == nil {
+			e := k
+			e.Example = req.URI
+			f = &e
+			flips[k] = f
+		}
+		f.Count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, f := range flips {
+		rep.Flips = append(rep.Flips, *f)
+	}
+	sort.Sort(byFlipCount(rep.Flips))
+	return rep, nil
+}
+
+// byFlipCount sorts flips most common first, then by client and domain.
+type byFlipCount []replayFlip
+
+func (a byFlipCount) Len() int      { return len(a) }
+func (a byFlipCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byFlipCount) Less(i, j int) bool {
+	if a[i].Count != a[j].Count {
+		return a[i].Count > a[j].Count
+	}
+	if a[i].Client != a[j].Client {
+		return a[i].Client < a[j].Client
+	}
+	if a[i].Domain != a[j].Domain {
+		return a[i].Domain < a[j].Domain
+	}
+	return a[i].To < a[j].To
+}
+
+// loadCandidate compiles the policy to replay against: the one in another
+// database, or the current one with SQL changes applied to a copy of it.
+func loadCandidate(dbPath, changes string) (*policy.Config, error) {
+	if dbPath != "" {
+		cdb, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+		if err != nil {
+			return nil, err
+		}
+		defer cdb.Close()
+		return policy.Load(cdb)
+	}
+
+	dir, err := ioutil.TempDir("", "squidwarden_replay_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "candidate.sqlite")
+	if _, err := db.Exec(`VACUUM INTO ?`, fn); err != nil {
+		return nil, fmt.Errorf("failed to copy database: %v", err)
+	}
+	cdb, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		return nil, err
+	}
+	defer cdb.Close()
+	if _, err := cdb.Exec(changes); err != nil {
+		return nil, fmt.Errorf("failed to apply changes: %v", err)
+	}
+	return policy.Load(cdb)
+}
+
+// replayFile replays a log file against the current policy and a candidate.
+func replayFile(fn, dbPath, changes string) (*replayReport, error) {
+	if dbPath == "" && strings.TrimSpace(changes) == "" {
+		return nil, fmt.Errorf("no candidate database or changes given")
+	}
+	current, err := policy.Load(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load current policy: %v", err)
+	}
+	candidate, err := loadCandidate(dbPath, changes)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return replay(f, current, candidate)
+}
+
+// replayLogFiles returns the logs Replay in the UI may read.
+func replayLogFiles() []string {
+	var ret []string
+	for _, fn := range append([]string{*squidLog}, strings.Split(*replayLogs, ",")...) {
+		if fn = strings.TrimSpace(fn); fn != "" {
+			ret = append(ret, fn)
+		}
+	}
+	return ret
+}
+
+// changesForbidden are SQL keywords not allowed in changes from the UI, since
+// they reach files other than the copy of the database.
+var changesForbidden = map[string]bool{
+	"ATTACH": true,
+	"DETACH": true,
+	"PRAGMA": true,
+	"VACUUM": true,
+}
+
+// checkChanges rejects SQL changes that use any of changesForbidden outside
+// of string literals, quoted identifiers and comments.
+func checkChanges(changes string) error {
+	for i := 0; i < len(changes); {
+		c := changes[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			n := strings.IndexByte(changes[i+1:], end)
+			if n < 0 {
+				return fmt.Errorf("unterminated quote")
+			}
+			i += n + 2
+		case strings.HasPrefix(changes[i:], "--"):
+			n := strings.IndexByte(changes[i:], '\n')
+			if n < 0 {
+				return nil
+			}
+			i += n + 1
+		case strings.HasPrefix(changes[i:], "/*"):
+			n := strings.Index(changes[i+2:], "*/")
+			if n < 0 {
+				return nil
+			}
+			i += n + 4
+		case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+			j := i + 1
+			for j < len(changes) && (changes[j] == '_' || changes[j] == '$' || (changes[j]|0x20 >= 'a' && changes[j]|0x20 <= 'z') || (changes[j] >= '0' && changes[j] <= '9')) {
+				j++
+			}
+			if w := strings.ToUpper(changes[i:j]); changesForbidden[w] {
+				return fmt.Errorf("%s is not allowed in changes", w)
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return nil
+}
+
+func replayHandler(r *http.Request) (template.HTML, error) {
+	tmpl := getTemplate("replay.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &struct {
+		Logs []string
+	}{
+		Logs: replayLogFiles(),
+	}); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// replayRunHandler replays one of replayLogFiles against the current policy
+// with changes applied. Other files and candidate databases are only for the
+// replay subcommand, since the UI shouldn't read any file it's told to.
+func replayRunHandler(r *http.Request) (interface{}, error) {
+	fn := r.FormValue("log")
+	ok := false
+	for _, l := range replayLogFiles() {
+		if fn == l {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, errHTTP{
+			internal: fmt.Errorf("log %q not in -squidlog or -replay_logs", fn),
+			external: "unknown log file",
+			code:     http.StatusBadRequest,
+		}
+	}
+	changes := r.FormValue("changes")
+	if err := checkChanges(changes); err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: err.Error(),
+			code:     http.StatusBadRequest,
+		}
+	}
+	log.Printf("Replaying %q against %d bytes of changes", fn, len(changes))
+	rep, err := replayFile(fn, "", changes)
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: err.Error(),
+			code:     http.StatusBadRequest,
+		}
+	}
+	return rep, nil
+}
+
+// replayMain is the replay subcommand, printing the requests in a log whose
+// decision a candidate policy would change.
+func replayMain(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	dbPath := fs.String("candidate", "", "Database with the candidate policy.")
+	changesFile := fs.String("changes", "", "File with SQL changes to apply to a copy of the current database, as the candidate policy.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (*dbPath == "") == (*changesFile == "") {
+		return fmt.Errorf("usage: %s [flags] replay -candidate=<db> | -changes=<sql file> <log file>", os.Args[0])
+	}
+	var changes string
+	if *changesFile != "" {
+		b, err := ioutil.ReadFile(*changesFile)
+		if err != nil {
+			return err
+		}
+		changes = string(b)
+	}
+	openDB()
+	rep, err := replayFile(fs.Arg(0), *dbPath, changes)
+	if err != nil {
+		return err
+	}
+	return rep.write(os.Stdout)
+}
+
+// write writes the report as a text table.
+func (rep *replayReport) write(w io.Writer) error {
+	fmt.Fprintf(w, "%d lines, %d requests replayed, %d bad lines, %d requests changed\n", rep.Lines, rep.Replayed, rep.Bad, rep.Flipped)
+	for _, e := range rep.Errors {
+		fmt.Fprintf(w, "Bad %s\n", e)
+	}
+	if len(rep.Flips) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "COUNT\tCLIENT\tDOMAIN\tFROM\tTO\tEXAMPLE\n")
+	for _, f := range rep.Flips {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", f.Count, f.Client, f.Domain, f.From, f.To, f.Example)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Access requests are filed by proxy users from the block page, and approved
+// or rejected by an admin from the request queue.
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	requestPending  = "pending"
+	requestApproved = "approved"
+	requestRejected = "rejected"
+
+	maxRequestURL  = 4096
+	maxRequestNote = 1000
+
+	// How many decided requests to show under the pending ones.
+	recentRequests = 50
+)
+
+type accessRequest struct {
+	RequestID string
+	Created   string
+	URL       string
+	Client    string
+	User      string
+	Note      string
+	Status    string
+	Reason    string
+	RuleID    string
+	Decided   string
+
+	// Rule suggested for approving the request.
+	Type  string
+	Value string
+}
+
+// suggestRule returns the rule type and value that would allow the URL of a
+// request, as squid logs it. CONNECT requests are just host:port.
+func suggestRule(u string) (string, string) {
+	if strings.Contains(u, "://") {
+		p, err := url.Parse(u)
+		if err != nil || p.Host == "" {
+			return typeExact, u
+		}
+		h := strings.ToLower(p.Host)
+		if p.Scheme == "http" {
+			h = strings.TrimSuffix(h, ":80")
+		}
+		return typeDomain, h
+	}
+	h := strings.ToLower(u)
+	return typeHTTPSDomain, strings.TrimSuffix(h, ":443")
+}
+
+// parseTrustedProxies parses -trusted_proxies: comma separated addresses and
+// networks.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy %q: %v", p, err)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// isTrusted returns true if ip is in one of the networks.
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestClient returns the address a request came from. That's the peer,
+// unless it's a trusted proxy, in which case it's the last address in
+// X-Forwarded-For that isn't one.
+func requestClient(r *http.Request, trusted []*net.IPNet) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	var fwd []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		fwd = append(fwd, strings.Split(h, ",")...)
+	}
+	for i := len(fwd) - 1; i >= 0 && isTrusted(client, trusted); i-- {
+		client = strings.TrimSpace(fwd[i])
+	}
+	return client
+}
+
+// requestAccessHandler files a new access request from the block page form,
+// and sends the user on to its status page. The client is where the form was
+// posted from, not what the block page was told, so that it can't be made up.
+func requestAccessHandler(w http.ResponseWriter, r *http.Request) {
+	u := strings.TrimSpace(r.FormValue("url"))
+	note := strings.TrimSpace(r.FormValue("note"))
+	client := requestClient(r, trustedProxies)
+	user := strings.TrimSpace(r.FormValue("user"))
+	if u == "" {
+		http.Error(w, "Missing URL", http.StatusBadRequest)
+		return
+	}
+	if len(u) > maxRequestURL || len(note) > maxRequestNote || len(client) > 100 || len(user) > 100 {
+		http.Error(w, "Request too long", http.StatusBadRequest)
+		return
+	}
+
+	id := uuid.NewV4().String()
+	log.Printf("Access request %s for %q from %q", id, u, client)
+	if _, err := db.Exec(`INSERT INTO access_requests(request_id, created, url, client, user, note, status) VALUES(?,?,?,?,?,?,?)`,
+		id, time.Now().Unix(), u, client, user, note, requestPending); err != nil {
+		log.Printf("Failed to insert access request: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/request-access/"+id, http.StatusSeeOther)
+}
+
+// requestStatusHandler shows the requester what happened to their request.
+func requestStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := assertUUID(mux.Vars(r)["requestID"])
+	reqs, err := getAccessRequests(`WHERE request_id=?`, id)
+	if err != nil {
+		log.Printf("Failed to load access request %s: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(reqs) == 0 {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return
+	}
+	renderStandalone(w, "request.html", http.StatusOK, &reqs[0])
+}
+
+// getAccessRequests loads access requests matching an SQL suffix.
+func getAccessRequests(where string, args ...interface{}) ([]accessRequest, error) {
+	rows, err := db.Query(`
+SELECT request_id, created, url, client, user, note, status, reason, rule_id, decided
+FROM access_requests
+`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []accessRequest
+	for rows.Next() {
+		var e accessRequest
+		var created int64
+		var client, user, note, reason, rule sql.NullString
+		var decided sql.NullInt64
+		if err := rows.Scan(&e.RequestID, &created, &e.URL, &client, &user, &note, &e.Status, &reason, &rule, &decided); err != nil {
+			return nil, err
+		}
+		e.Created = time.Unix(created, 0).UTC().Format(saneTime)
+		e.Client = client.String
+		e.User = user.String
+		e.Note = note.String
+		e.Reason = reason.String
+		e.RuleID = rule.String
+		if decided.Valid {
+			e.Decided = time.Unix(decided.Int64, 0).UTC().Format(saneTime)
+		}
+		e.Type, e.Value = suggestRule(e.URL)
+		ret = append(ret, e)
+	}
+	return ret, rows.Err()
+}
+
+func requestsHandler(r *http.Request) (template.HTML, error) {
+	data := struct {
+		Pending []accessRequest
+		Recent  []accessRequest
+		ACLs    []acl
+		Types   []string
+	}{
+		Types: []string{typeDomain, typeHTTPSDomain, typeRegex, typeHTTPSRegex, typeExact, typePathPrefix, typeHostGlob, typeSNI, typeCertName},
+	}
+	var err error
+	if data.Pending, err = getAccessRequests(`WHERE status=? ORDER BY created`, requestPending); err != nil {
+		return "", err
+	}
+	if data.Recent, err = getAccessRequests(`WHERE status<>? ORDER BY decided DESC LIMIT ?`, requestPending, recentRequests); err != nil {
+		return "", err
+	}
+	if data.ACLs, err = getACLs(); err != nil {
+		return "", err
+	}
+
+	tmpl := getTemplate("requests.html", nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return "", fmt.Errorf("template execute fail: %v", err)
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// decideRequest marks a pending request as decided, failing if someone else
+// got to it first.
+func decideRequest(tx *sql.Tx, id, status, reason, rule string) error {
+	res, err := tx.Exec(`UPDATE access_requests SET status=?, reason=?, rule_id=?, decided=? WHERE request_id=? AND status=?`,
+		status, reason, sql.NullString{String: rule, Valid: rule != ""}, time.Now().Unix(), id, requestPending)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return errHTTP{
+			external: "request not found or already decided",
+			code:     http.StatusConflict,
+		}
+	}
+	return nil
+}
+
+func requestApproveHandler(r *http.Request) (interface{}, error) {
+	id := assertUUID(mux.Vars(r)["requestID"])
+	typ := r.FormValue("type")
+	value := strings.TrimSpace(r.FormValue("value"))
+	dst := r.FormValue("acl")
+	if typ == "" || value == "" || !reUUID.MatchString(dst) {
+		return nil, errHTTP{
+			external: "Missing parameters",
+			code:     http.StatusBadRequest,
+		}
+	}
+	if err := validateRule(typ, value); err != nil {
+		return nil, err
+	}
+
+	reqs, err := getAccessRequests(`WHERE request_id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, errHTTP{
+			external: "request not found",
+			code:     http.StatusNotFound,
+		}
+	}
+	comment := "Requested by " + reqs[0].Client
+	if reqs[0].User != "" {
+		// The user is only what the block page was told.
+		comment = "Requested by " + reqs[0].User + " from " + reqs[0].Client
+	}
+	if reqs[0].Note != "" {
+		comment += ": " + reqs[0].Note
+	}
+
+	log.Printf("Approving access request %s into ACL %s", id, dst)
+	return "OK", txWrap(func(tx *sql.Tx) error {
+		rule, err := addRule(tx, aclID(dst), typ, value, actionAllow, comment)
+		if err != nil {
+			return err
+		}
+		return decideRequest(tx, id, requestApproved, "", rule)
+	})
+}
+
+func requestRejectHandler(r *http.Request) (interface{}, error) {
+	id := assertUUID(mux.Vars(r)["requestID"])
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	log.Printf("Rejecting access request %s: %q", id, reason)
+	return "OK", txWrap(func(tx *sql.Tx) error {
+		return decideRequest(tx, id, requestRejected, reason, "")
+	})
+}
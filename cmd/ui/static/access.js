@@ -5,6 +5,18 @@ $(document).ready(function() {
     $("#access-group-selection").change(function(e) {
 	window.location.href = "/access/" + $(this).val();
     });
+    $("#access-default-action").change(function() {
+	doPost("/group/" + $("#access-group-selection").val() + "/default", {
+	    "action": $(this).val()
+	});
+    });
+    $("#access-global-default").change(function() {
+	doPost("/default", {
+	    "action": $(this).val()
+	}, function() {
+	    window.location.reload();
+	});
+    });
     $("#button-update").click(update);
     // $("table#acl-rules input.checked-rules").change(function() {checkedRulesChanged($(this))});
     //changeSelected(1);
@@ -13,18 +25,28 @@ $(document).ready(function() {
 function update() {
     var active = new Array;
     var comments = new Array;
+    var schedules = new Array;
+    var valid_froms = new Array;
+    var valid_untils = new Array;
     $(".access-acl-checked:checked").each(function(index) {
 	var aclid = $(this).data("aclid");
 	active[index] = aclid;
 	comments[index] = $("#access-comment-" + aclid).val();
+	schedules[index] = $("#access-schedule-" + aclid).val();
+	valid_froms[index] = $("#access-valid-from-" + aclid).val();
+	valid_untils[index] = $("#access-valid-until-" + aclid).val();
     });
     var data = {};
     data["acls"] = active;
     data["comments"] = comments;
+    data["schedules"] = schedules;
+    data["valid_froms"] = valid_froms;
+    data["valid_untils"] = valid_untils;
     doPost("/access/" + $("#access-group-selection").val(),
 	   data,
 	   function() {
 	       console.log("success");
+	       window.location.reload();
 	   });
 }
 
@@ -31,6 +31,20 @@ $(document).ready(function() {
 	});
     });
 
+    // Change ACL priority.
+    $("#change-priority").click(function() {
+	var acl_id = $("#current-acl").val();
+	doPost("/acl/" + acl_id, {"priority": $("#priority").val()}, function(){
+	    window.location.reload();
+	});
+    });
+
+    // Stale rule filter.
+    $("#stale-filter").click(function() {
+	var acl_id = $("#current-acl").val();
+	window.location.href = "/acl/" + acl_id + "?stale=" + $("#stale-days").val();
+    });
+
     // Rule selection.
     $("#acl-rules input.checked-rules").change(function() { checkedRulesChanged($(this)); });
     changeSelected(0);
@@ -53,6 +67,7 @@ function updateActionColors() {
     o.removeClass("acl-button-allow");
     $("select.acl-rules-rule-action option[value='allow']:selected").parent().addClass("acl-button-allow");
     $("select.acl-rules-rule-action option[value='ignore']:selected").parent().addClass("acl-button-block");
+    $("select.acl-rules-rule-action option[value='block']:selected").parent().addClass("acl-button-block");
 }
 
 function delete_button() {
@@ -5,8 +5,8 @@ $(document).ready(function() {
     $("#members-group-selection").change(function(e) {
 	window.location.href = "/members/" + $(this).val();
     });
-    $(".members-source-checked,.members-comment").change(changeAnything);
-    $(".members-comment").keydown(changeAnything);
+    $(".members-source-checked,.members-comment,.members-valid-from,.members-valid-until").change(changeAnything);
+    $(".members-comment,.members-valid-from,.members-valid-until").keydown(changeAnything);
     $("#action-new-group").keydown(function(e) {
 	if (e.keyCode != 13) { return; }
 	newGroup($(this).val());
@@ -17,6 +17,12 @@ $(document).ready(function() {
 	    window.location.href = "/members/";
 	});
     });
+    $("#members-default-action").change(function() {
+	var group_id = $("#current-group").val();
+	doPost("/group/" + group_id + "/default", {
+	    "action": $(this).val()
+	});
+    });
     $("#action-save").click(btnSave);
     $("#action-new").click(btnCreate);
     $(".action-delete").click(btnDelete);
@@ -34,14 +40,19 @@ function changeAnything() {
 
     $(".members-source-checked:checked").each(function() {
 	var sid = $(this).data("sourceid");
-	$(".members-comment[data-sourceid="+sid+"]").prop("disabled", false);
+	memberInputs(sid).prop("disabled", false);
     });
     $(".members-source-checked:not(:checked)").each(function() {
 	var sid = $(this).data("sourceid");
-	$(".members-comment[data-sourceid="+sid+"]").prop("disabled", true);
+	memberInputs(sid).prop("disabled", true);
     });
 }
 
+// memberInputs returns the inputs for a source's membership.
+function memberInputs(sid) {
+    return $(".members-comment[data-sourceid="+sid+"],.members-valid-from[data-sourceid="+sid+"],.members-valid-until[data-sourceid="+sid+"]");
+}
+
 function btnCreate() {
     var group_id = $("#members-group-selection").val();
     doPost("/members/"+group_id+"/new", {
@@ -66,14 +77,20 @@ function btnSave() {
     var group_id = $("#members-group-selection").val();
     var sources = new Array;
     var comments = new Array;
+    var valid_froms = new Array;
+    var valid_untils = new Array;
     $(".members-source-checked:checked").each(function(index) {
 	var sid = $(this).data("sourceid");
 	sources[index] = sid;
 	comments[index] = $(".members-comment[data-sourceid="+sid+"]").val();
+	valid_froms[index] = $(".members-valid-from[data-sourceid="+sid+"]").val();
+	valid_untils[index] = $(".members-valid-until[data-sourceid="+sid+"]").val();
     });
     var data = {
 	"sources": sources,
 	"comments": comments,
+	"valid_froms": valid_froms,
+	"valid_untils": valid_untils,
     };
     doPost("/members/" + group_id + "/members", data,
 	   function() {
@@ -83,13 +100,13 @@ function btnSave() {
 	       $(".members-source-checked:not(:checked)").each(function(index) {
 		   var sid = $(this).data("sourceid");
 		   $("button[data-sourceid="+sid+"]").prop("disabled", false);
-		   $(".members-comment[data-sourceid="+sid+"]").val("");
-		   $(".members-comment[data-sourceid="+sid+"]").prop("disabled", true);
+		   memberInputs(sid).val("");
+		   memberInputs(sid).prop("disabled", true);
 	       });
 	       $(".members-source-checked:checked").each(function(index) {
 		   var sid = $(this).data("sourceid");
 		   $("button[data-sourceid="+sid+"]").prop("disabled", true);
-		   $(".members-comment[data-sourceid="+sid+"]").prop("disabled", false);
+		   memberInputs(sid).prop("disabled", false);
 	       });
 	   });
 }
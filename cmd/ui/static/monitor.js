@@ -0,0 +1,39 @@
+$(document).ready(function() {
+    var group_id = $("#current-group").val();
+    $("#monitor-group-selection").change(function(e) {
+	window.location.href = "/monitor/" + $(this).val();
+    });
+    $("#monitor-enabled").change(function() {
+	doPost("/group/" + group_id + "/monitor", {
+	    "monitor": $(this).prop("checked")
+	});
+    });
+    $("#monitor-select-all").change(function() {
+	$(".monitor-selected").prop("checked", $(this).prop("checked"));
+    });
+    $("#monitor-create-acl").click(function() {
+	var sites = [];
+	var types = [];
+	var values = [];
+	$(".monitor-entry").each(function() {
+	    if (!$(this).find(".monitor-selected").prop("checked")) {
+		return;
+	    }
+	    sites.push($(this).data("site"));
+	    types.push($(this).find(".monitor-type").val());
+	    values.push($(this).find(".monitor-value").val());
+	});
+	doPost("/monitor/" + group_id + "/acl", {
+	    "sites": sites,
+	    "types": types,
+	    "values": values
+	}, function(data) {
+	    window.location.href = "/acl/" + data.acl;
+	});
+    });
+    $("#monitor-clear").click(function() {
+	doPost("/monitor/" + group_id + "/clear", {}, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,39 @@
+$(document).ready(function() {
+    $("#replay-run").click(function() {
+	var data = {
+	    "log": $("#replay-log").val(),
+	    "changes": $("#replay-changes").val()
+	};
+	doPost("/replay/run", data, function(rep) {
+	    var res = $("#replay-result");
+	    res.empty();
+	    res.append($("<p>").text(rep.Lines + " lines, " + rep.Replayed + " requests replayed, "
+				     + rep.Bad + " bad lines, " + rep.Flipped + " requests changed."));
+	    $.each(rep.Errors || [], function(i, e) {
+		res.append($("<p>").text("Bad " + e));
+	    });
+	    if (!rep.Flips) {
+		return;
+	    }
+	    var tbody = $("<tbody>");
+	    $.each(rep.Flips, function(i, f) {
+		tbody.append($("<tr>")
+			     .append($("<td class='min'>").text(f.Count))
+			     .append($("<td class='min fixed'>").text(f.Client))
+			     .append($("<td class='min fixed'>").text(f.Domain))
+			     .append($("<td class='min'>").text(f.From))
+			     .append($("<td class='min'>").text(f.To))
+			     .append($("<td class='fixed'>").text(f.Example)));
+	    });
+	    res.append($("<table class='standard'>")
+		       .append($("<thead>").append($("<tr>")
+						   .append($("<th>").text("Count"))
+						   .append($("<th>").text("Client"))
+						   .append($("<th>").text("Domain"))
+						   .append($("<th>").text("Now"))
+						   .append($("<th>").text("Candidate"))
+						   .append($("<th>").text("Example"))))
+		       .append(tbody));
+	});
+    });
+});
@@ -0,0 +1,23 @@
+$(document).ready(function() {
+    $(".request-approve").click(function() {
+	var id = $(this).data("requestid");
+	var data = {
+	    "type": $(".request-type[data-requestid='"+id+"']").val(),
+	    "value": $(".request-value[data-requestid='"+id+"']").val(),
+	    "acl": $(".request-acl[data-requestid='"+id+"']").val()
+	};
+	doPost("/requests/" + id + "/approve", data, function() {
+	    window.location.reload();
+	});
+    });
+
+    $(".request-reject").click(function() {
+	var id = $(this).data("requestid");
+	var data = {
+	    "reason": $(".request-reason[data-requestid='"+id+"']").val()
+	};
+	doPost("/requests/" + id + "/reject", data, function() {
+	    window.location.reload();
+	});
+    });
+});
@@ -0,0 +1,19 @@
+$(document).ready(function() {
+    $("#rule-methods-save").click(function() {
+	var rule_id = $("#current-rule").val();
+	doPost("/rule/" + rule_id + "/methods",
+	       {"methods": $("#rule-methods").val()},
+	       function() {
+		   window.location.reload();
+	       });
+    });
+    $("#rule-validity-save").click(function() {
+	var rule_id = $("#current-rule").val();
+	doPost("/rule/" + rule_id + "/validity",
+	       {"valid_from": $("#rule-valid-from").val(),
+		"valid_until": $("#rule-valid-until").val()},
+	       function() {
+		   window.location.reload();
+	       });
+    });
+});
@@ -92,7 +92,37 @@ function ajaxError(o, text, error) {
     return msg;
 }
 
+// countdownText is the same as countdown() on the server.
+function countdownText(from, until, now) {
+    function short(s) {
+	if (s >= 86400) {
+	    return Math.floor(s/86400) + "d " + Math.floor(s%86400/3600) + "h";
+	} else if (s >= 3600) {
+	    return Math.floor(s/3600) + "h " + Math.floor(s%3600/60) + "m";
+	} else if (s >= 60) {
+	    return Math.floor(s/60) + "m " + (s%60) + "s";
+	}
+	return s + "s";
+    }
+    if (from > now) {
+	return "starts in " + short(from-now);
+    } else if (until == 0) {
+	return "";
+    } else if (until <= now) {
+	return "expired";
+    }
+    return "expires in " + short(until-now);
+}
+
+function updateCountdowns() {
+    var now = Math.floor(Date.now() / 1000);
+    $(".countdown").each(function() {
+	$(this).text(countdownText($(this).data("from"), $(this).data("until"), now));
+    });
+}
+
 $(document).ready(function() {
+    setInterval(updateCountdowns, 1000);
     $.ajaxPrefilter(function (options, originalOptions, jqXHR) {
 	jqXHR.setRequestHeader('X-CSRF-Token', $("#csrf").val());
     });
@@ -0,0 +1,134 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// The helper's state, as written to its -status_file, shown as a banner
+// when it's not deciding from the database.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type helperStatus struct {
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Error    string    `json:"error"`
+	FailMode string    `json:"fail_mode"`
+}
+
+// stateRank orders helper states from best to worst. Unknown ones are worse.
+var stateRank = map[string]int{
+	"ok":       0,
+	"stale":    1,
+	"snapshot": 2,
+	"none":     3,
+}
+
+func rankState(s string) int {
+	if r, ok := stateRank[s]; ok {
+		return r
+	}
+	return len(stateRank)
+}
+
+// statusFiles returns the status files of the helper processes given fn as
+// -status_file. Each adds its process ID before the extension.
+func statusFiles(fn string) ([]string, error) {
+	dir, base := filepath.Split(fn)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "."
+	fs, err := ioutil.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, f := range fs {
+		n := f.Name()
+		if !strings.HasPrefix(n, prefix) || !strings.HasSuffix(n, ext) || len(n) <= len(prefix)+len(ext) {
+			continue
+		}
+		if _, err := strconv.Atoi(n[len(prefix) : len(n)-len(ext)]); err != nil {
+			continue
+		}
+		ret = append(ret, filepath.Join(dir, n))
+	}
+	return ret, nil
+}
+
+// helperWarning returns what's wrong with the helper processes, or "" if
+// nothing is. Squid runs several, so it's about the worst off one.
+func helperWarning(fn string) string {
+	if fn == "" {
+		return ""
+	}
+	files, err := statusFiles(fn)
+	if err != nil {
+		return fmt.Sprintf("Can't read the helper status: %v", err)
+	}
+	if len(files) == 0 {
+		return fmt.Sprintf("Can't read the helper status: no helper process has written one next to %q", fn)
+	}
+	var worst helperStatus
+	bad := 0
+	for n, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return fmt.Sprintf("Can't read the helper status: %v", err)
+		}
+		var st helperStatus
+		if err := json.Unmarshal(b, &st); err != nil {
+			return fmt.Sprintf("Bad helper status file %q: %v", f, err)
+		}
+		if st.State != "ok" {
+			bad++
+		}
+		if n == 0 || rankState(st.State) > rankState(worst.State) {
+			worst = st
+		}
+	}
+	w := statusWarning(&worst)
+	if w != "" && len(files) > 1 {
+		w = fmt.Sprintf("%s (%d of %d helper processes are degraded.)", w, bad, len(files))
+	}
+	return w
+}
+
+// statusWarning returns what's wrong with one helper process, or "" if
+// nothing is.
+func statusWarning(st *helperStatus) string {
+	since := st.Since.UTC().Format(saneTime)
+	switch st.State {
+	case "ok":
+		return ""
+	case "stale":
+		return fmt.Sprintf("The helper has failed to reload the policy since %s, and uses the last one it loaded. Changes made here don't take effect. Error: %s", since, st.Error)
+	case "snapshot":
+		return fmt.Sprintf("The helper couldn't read the database at startup, and uses its policy snapshot since %s. Changes made here don't take effect. Error: %s", since, st.Error)
+	case "none":
+		what := "blocks"
+		if st.FailMode == "open" {
+			what = "allows"
+		}
+		return fmt.Sprintf("The helper has no policy, and %s everything since %s. Error: %s", what, since, st.Error)
+	}
+	return fmt.Sprintf("The helper is in unknown state %q since %s", st.State, since)
+}
@@ -67,9 +67,11 @@ func tailHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Upgrade failed", http.StatusBadRequest)
 		return
 	}
+	tailWebsockets.Add(1)
 	defer func() {
 		//log.Printf("Closing websocket")
 		conn.Close()
+		tailWebsockets.Add(-1)
 	}()
 	changeTick := make(chan struct{}, 1)
 	changeTick <- struct{}{}
@@ -34,11 +34,16 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	texttemplate "text/template"
 	"time"
 
+	"github.com/google/squidwarden/hostglob"
+	"github.com/google/squidwarden/metrics"
+	"github.com/google/squidwarden/policy"
+	"github.com/google/squidwarden/schedule"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
@@ -60,6 +65,10 @@ const (
 	typeExact       = "exact"
 	typeRegex       = "regex"
 	typeHTTPSRegex  = "https-regex"
+	typePathPrefix  = "path-prefix"
+	typeHostGlob    = "host-glob"
+	typeSNI         = "sni"
+	typeCertName    = "cert-name"
 
 	saneTime = "2006-01-02 15:04:05 MST"
 )
@@ -76,14 +85,19 @@ var (
 	proxyHostPort = flag.String("proxy", "", "Host:port to proxy.")
 	hsts          = flag.Duration("hsts_ttl", 0, "HSTS TTL. If 0 don't set header.")
 	wsSelf        = flag.String("csp_ws", "", "ws/wss URL to allow for CSP. 'self' is implied.")
+	statusFile    = flag.String("helper_status", "", "The helper's -status_file, to warn when any helper process isn't using the policy in the database.")
+	replayLogs    = flag.String("replay_logs", "", "Comma separated logs besides -squidlog that Replay may read, e.g. the helper's -decision_log.")
+	trustedList   = flag.String("trusted_proxies", "", "Comma separated addresses and networks of proxies between clients and the UI, including squid for the block page, whose X-Forwarded-For is believed for who files access requests.")
 
-	db *sql.DB
+	db             *sql.DB
+	trustedProxies []*net.IPNet // Parsed -trusted_proxies.
 )
 
 type aclID string
 type acl struct {
-	ACLID   aclID
-	Comment string
+	ACLID    aclID
+	Comment  string
+	Priority int
 }
 type sourceID string
 type source struct {
@@ -99,6 +113,17 @@ type rule struct {
 	Value   string
 	Action  string
 	Comment string
+
+	// Comma separated HTTP methods the rule applies to. Empty means all.
+	Methods string
+
+	validity
+
+	// Hits counted by the helper, and when the last one was. LastHit is
+	// empty if never.
+	Hits    int64
+	LastHit string
+	lastHit time.Time
 }
 
 // given a FQDN, return from the registered domain and on.
@@ -162,6 +187,69 @@ func pacHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// blockInfo is what the block page knows about a denied request.
+type blockInfo struct {
+	URL    string
+	Client string
+	User   string
+	Reason string
+	Time   string
+}
+
+// parseBlockInfo reads the query string squid builds from a deny_info URL
+// such as "/blocked?url=%u&client=%i&user=%a&reason=%o&time=%T". Squid
+// leaves "-" in place of unknown values.
+func parseBlockInfo(q url.Values, now time.Time) blockInfo {
+	get := func(k string) string {
+		if v := strings.TrimSpace(q.Get(k)); v != "-" {
+			return v
+		}
+		return ""
+	}
+	t := now
+	if ts := get("time"); ts != "" {
+		if pt, err := http.ParseTime(ts); err == nil {
+			t = pt
+		}
+	}
+	return blockInfo{
+		URL:    get("url"),
+		Client: get("client"),
+		User:   get("user"),
+		Reason: get("reason"),
+		Time:   t.UTC().Format(saneTime),
+	}
+}
+
+// blockedHandler serves the page squid redirects to on deny. It's shown to
+// proxy users rather than admins, so it's not wrapped in page.html. It has
+// the form for filing an access request.
+func blockedHandler(w http.ResponseWriter, r *http.Request) {
+	renderStandalone(w, "blocked.html", http.StatusForbidden, &struct {
+		blockInfo
+		CSRF string
+	}{
+		blockInfo: parseBlockInfo(r.URL.Query(), time.Now()),
+		CSRF:      csrf.Token(r),
+	})
+}
+
+// renderStandalone renders a page meant for proxy users, without the admin
+// navigation in page.html.
+func renderStandalone(w http.ResponseWriter, fn string, code int, data interface{}) {
+	tmpl := getTemplate(fn, nil)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Printf("template execute fail: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
 func aboutHandler(r *http.Request) (template.HTML, error) {
 	tmpl := getTemplate("about.html", nil)
 	var buf bytes.Buffer
@@ -207,40 +295,104 @@ func ruleNewHandler(r *http.Request) (interface{}, error) {
 		}
 	}
 
-	aclID := newACLID
+	if err := validateRule(data.typ, data.value); err != nil {
+		return nil, err
+	}
 
-	id := uuid.NewV4().String()
-	resp := struct {
+	var id string
+	err := txWrap(func(tx *sql.Tx) error {
+		var err error
+		id, err = createRule(tx, newACLID, data.typ, data.value, data.action, "")
+		return err
+	})
+	return &struct {
 		Rule string `json:"rule"`
-	}{Rule: id}
-	return &resp, txWrap(func(tx *sql.Tx) error {
-		log.Printf("Adding rule %q", id)
-		if _, err := tx.Exec(`INSERT INTO rules(rule_id, action, type, value) VALUES(?,?,?,?)`, id, data.action, data.typ, data.value); err != nil {
-			var existing string
-			if e := tx.QueryRow(`SELECT rule_id FROM rules WHERE type=? AND value=?`, data.typ, data.value).Scan(&existing); e != nil {
-				return errHTTP{
-					internal: fmt.Errorf("first %q, then %q", err, e),
-					external: "failed to insert rule",
-					code:     http.StatusInternalServerError,
-				}
+	}{Rule: id}, err
+}
+
+// createRule adds a new rule to an ACL, returning its ID. Creating a
+// duplicate of an existing rule is an error that links to the existing one.
+func createRule(tx *sql.Tx, acl aclID, typ, value, action, comment string) (string, error) {
+	id := uuid.NewV4().String()
+	log.Printf("Adding rule %q", id)
+	if _, err := tx.Exec(`INSERT INTO rules(rule_id, action, type, value, comment) VALUES(?,?,?,?,?)`, id, action, typ, value, sql.NullString{String: comment, Valid: comment != ""}); err != nil {
+		var existing string
+		if e := tx.QueryRow(`SELECT rule_id FROM rules WHERE type=? AND value=?`, typ, value).Scan(&existing); e != nil {
+			return "", errHTTP{
+				internal: fmt.Errorf("first %q, then %q", err, e),
+				external: "failed to insert rule",
+				code:     http.StatusInternalServerError,
 			}
-			return errHTTP{
-				internal: nil,
-				external: fmt.Sprintf("refusing to create duplicate of rule %s", existing),
-				links: []errHTTPLink{
-					{
-						Text: "existing rule",
-						Link: "/rule/" + existing,
-					},
+		}
+		return "", errHTTP{
+			internal: nil,
+			external: fmt.Sprintf("refusing to create duplicate of rule %s", existing),
+			links: []errHTTPLink{
+				{
+					Text: "existing rule",
+					Link: "/rule/" + existing,
 				},
-				code: http.StatusConflict,
+			},
+			code: http.StatusConflict,
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO aclrules(acl_id, rule_id) VALUES(?, ?)`, string(acl), id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// addRule adds a rule to acl, reusing the existing rule with the same type,
+// value and action if there is one, since rules are unique. A new rule gets
+// comment.
+func addRule(tx *sql.Tx, acl aclID, typ, value, action, comment string) (string, error) {
+	var id string
+	err := tx.QueryRow(`SELECT rule_id FROM rules WHERE type=? AND value=? AND action=?`, typ, value, action).Scan(&id)
+	if err == sql.ErrNoRows {
+		return createRule(tx, acl, typ, value, action, comment)
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Adding existing rule %q to ACL %q", id, acl)
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO aclrules(acl_id, rule_id) VALUES(?, ?)`, string(acl), id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// validateRule checks that a rule value is valid for its type, so that the
+// helper won't fail to load the policy, and that it can match.
+func validateRule(typ, value string) error {
+	var err error
+	switch typ {
+	case typeHostGlob:
+		host, port := value, ""
+		if n := strings.LastIndexByte(value, ':'); n >= 0 {
+			host, port = value[:n], value[n+1:]
+			if _, e := strconv.ParseUint(port, 10, 16); e != nil && port != "*" {
+				err = fmt.Errorf("invalid port %q", port)
+				break
 			}
 		}
-		if _, err := tx.Exec(`INSERT INTO aclrules(acl_id, rule_id) VALUES(?, ?)`, string(aclID), id); err != nil {
-			return err
+		_, err = hostglob.Compile(host)
+	case typeSNI, typeCertName:
+		// A host or .domain, since that's all TLS names are matched as.
+		if v := strings.TrimPrefix(value, "."); v == "" || strings.ContainsAny(v, ":/* \t") {
+			err = fmt.Errorf("want a host or .domain")
 		}
-		return nil
-	})
+	}
+	if err == nil {
+		err = policy.ValidateRule(typ, value)
+	}
+	if err != nil {
+		return errHTTP{
+			internal: err,
+			external: fmt.Sprintf("invalid %s rule %q: %v", typ, value, err),
+			code:     http.StatusBadRequest,
+		}
+	}
+	return nil
 }
 
 func reverse(s []string) []string {
@@ -372,12 +524,14 @@ func errWrap(f func(*http.Request) (template.HTML, error)) func(http.ResponseWri
 			Version    string
 			Websockets bool
 			CSRF       string
+			Warning    string
 			Content    template.HTML
 		}{
 			Now:        time.Now().UTC().Format(saneTime),
 			Version:    version,
 			Websockets: *websockets && *socketPath == "",
 			CSRF:       csrf.Token(r),
+			Warning:    helperWarning(*statusFile),
 			Content:    h,
 		}); err != nil {
 			log.Printf("Error in main handler: %v", err)
@@ -391,6 +545,27 @@ const uuidRE = `[\da-f]{8}-[\da-f]{4}-[\da-f]{4}-[\da-f]{4}-[\da-f]{12}`
 
 var reUUID = regexp.MustCompile(`^` + uuidRE + `$`)
 
+var reMethod = regexp.MustCompile(`^[A-Z-]+$`)
+
+// normalizeMethods turns a comma or space separated list of HTTP methods into
+// the canonical form stored in the database. Empty means all methods.
+func normalizeMethods(s string) (string, error) {
+	seen := make(map[string]bool)
+	var l []string
+	for _, m := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		m = strings.ToUpper(m)
+		if !reMethod.MatchString(m) {
+			return "", fmt.Errorf("invalid HTTP method %q", m)
+		}
+		if !seen[m] {
+			seen[m] = true
+			l = append(l, m)
+		}
+	}
+	sort.Strings(l)
+	return strings.Join(l, ","), nil
+}
+
 func txWrap(f func(tx *sql.Tx) error) error {
 	tx, err := db.Begin()
 	if err != nil {
@@ -475,12 +650,31 @@ func accessUpdateHandler(r *http.Request) (interface{}, error) {
 		return nil, fmt.Errorf("acl list and comment list length unequal. acl=%d comment=%d", len(acls), len(comments))
 	}
 
+	schedules := r.Form["schedules[]"]
+	if len(schedules) != len(acls) {
+		return nil, fmt.Errorf("acl list and schedule list length unequal. acl=%d schedule=%d", len(acls), len(schedules))
+	}
+	for n, s := range schedules {
+		if _, err := schedule.Parse(s); err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("bad schedule for ACL %s: %v", acls[n], err),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+
+	valids, err := formValidities(r.Form["valid_froms[]"], r.Form["valid_untils[]"], len(acls))
+	if err != nil {
+		return nil, err
+	}
+
 	return "OK", txWrap(func(tx *sql.Tx) error {
 		if _, err := tx.Exec(`DELETE FROM groupaccess WHERE group_id=?`, string(groupID)); err != nil {
 			return err
 		}
 		for n := range acls {
-			if _, err := tx.Exec(`INSERT INTO groupaccess(group_id, acl_id, comment) VALUES(?,?,?)`, string(groupID), acls[n], comments[n]); err != nil {
+			if _, err := tx.Exec(`INSERT INTO groupaccess(group_id, acl_id, comment, schedule, valid_from, valid_until) VALUES(?,?,?,?,?,?)`, string(groupID), acls[n], comments[n], schedules[n], nullTime(valids[n].ValidFrom), nullTime(valids[n].ValidUntil)); err != nil {
 				return err
 			}
 		}
@@ -492,6 +686,10 @@ type groupID string
 type group struct {
 	GroupID groupID
 	Comment string
+	Monitor bool
+
+	// What to do if no rule matches. Empty for the global default.
+	DefaultAction string
 }
 
 func membersHandler(r *http.Request) (template.HTML, error) {
@@ -501,11 +699,14 @@ func membersHandler(r *http.Request) (template.HTML, error) {
 		Active  bool
 		Comment string
 		Source  source
+		validity
 	}
 	data := struct {
 		Groups  []group
 		Current group
 		Sources []maybeSource
+
+		GlobalDefault string
 	}{}
 	{
 		var err error
@@ -513,6 +714,9 @@ func membersHandler(r *http.Request) (template.HTML, error) {
 		if err != nil {
 			return "", fmt.Errorf("getGroups: %v", err)
 		}
+		if data.GlobalDefault, err = getDefaultAction(); err != nil {
+			return "", err
+		}
 	}
 	if len(current) > 0 {
 		active, err := getGroupSources(current)
@@ -526,7 +730,10 @@ func membersHandler(r *http.Request) (template.HTML, error) {
 		}
 		for _, a := range sources {
 			e := maybeSource{Source: a}
-			e.Comment, e.Active = active[a.SourceID]
+			var gs groupSource
+			gs, e.Active = active[a.SourceID]
+			e.Comment = gs.Comment
+			e.validity = gs.validity
 			data.Sources = append(data.Sources, e)
 		}
 	}
@@ -542,7 +749,7 @@ func membersHandler(r *http.Request) (template.HTML, error) {
 func getGroups(currentID groupID) ([]group, group, error) {
 	var groups []group
 	var current group
-	rows, err := db.Query(`SELECT group_id, comment FROM groups ORDER BY comment`)
+	rows, err := db.Query(`SELECT group_id, comment, monitor, default_action FROM groups ORDER BY comment`)
 	if err != nil {
 		return nil, group{}, err
 	}
@@ -550,13 +757,16 @@ func getGroups(currentID groupID) ([]group, group, error) {
 
 	for rows.Next() {
 		var s string
-		var c sql.NullString
-		if err := rows.Scan(&s, &c); err != nil {
+		var c, d sql.NullString
+		var m bool
+		if err := rows.Scan(&s, &c, &m, &d); err != nil {
 			return nil, group{}, err
 		}
 		e := group{
-			GroupID: groupID(s),
-			Comment: c.String,
+			GroupID:       groupID(s),
+			Comment:       c.String,
+			Monitor:       m,
+			DefaultAction: d.String,
 		}
 		groups = append(groups, e)
 		if currentID == e.GroupID {
@@ -573,14 +783,22 @@ func accessHandler(r *http.Request) (template.HTML, error) {
 	current := groupID(mux.Vars(r)["groupID"])
 
 	type maybeACL struct {
-		Active  bool
-		Comment string
-		ACL     acl
+		Active   bool
+		Comment  string
+		Schedule string
+		validity
+
+		// Granted, and schedule says it's in effect now.
+		ActiveNow bool
+
+		ACL acl
 	}
 	data := struct {
 		Groups  []group
 		Current group
 		ACLs    []maybeACL
+
+		GlobalDefault string
 	}{}
 	{
 		var err error
@@ -588,6 +806,9 @@ func accessHandler(r *http.Request) (template.HTML, error) {
 		if err != nil {
 			return "", err
 		}
+		if data.GlobalDefault, err = getDefaultAction(); err != nil {
+			return "", err
+		}
 	}
 	if len(current) > 0 {
 		active, err := getGroupACLs(current)
@@ -599,9 +820,21 @@ func accessHandler(r *http.Request) (template.HTML, error) {
 		if err != nil {
 			return "", err
 		}
+		now := time.Now()
 		for _, a := range acls {
 			e := maybeACL{ACL: a}
-			e.Comment, e.Active = active[a.ACLID]
+			var ga groupACL
+			ga, e.Active = active[a.ACLID]
+			e.Comment = ga.Comment
+			e.Schedule = ga.Schedule
+			e.validity = ga.validity
+			if e.Active {
+				if sched, err := schedule.Parse(ga.Schedule); err != nil {
+					log.Printf("Bad schedule %q for group %s ACL %s: %v", ga.Schedule, current, a.ACLID, err)
+				} else {
+					e.ActiveNow = sched.Active(now) && e.activeAt(now)
+				}
+			}
 			data.ACLs = append(data.ACLs, e)
 		}
 	}
@@ -614,10 +847,17 @@ func accessHandler(r *http.Request) (template.HTML, error) {
 	return template.HTML(buf.String()), nil
 }
 
-func getGroupACLs(g groupID) (map[aclID]string, error) {
-	acls := make(map[aclID]string)
+// groupACL is an ACL granted to a group.
+type groupACL struct {
+	Comment  string
+	Schedule string
+	validity
+}
+
+func getGroupACLs(g groupID) (map[aclID]groupACL, error) {
+	acls := make(map[aclID]groupACL)
 
-	rows, err := db.Query(`SELECT acl_id, comment FROM groupaccess WHERE group_id=?`, string(g))
+	rows, err := db.Query(`SELECT acl_id, comment, schedule, valid_from, valid_until FROM groupaccess WHERE group_id=?`, string(g))
 	if err != nil {
 		return nil, err
 	}
@@ -625,11 +865,16 @@ func getGroupACLs(g groupID) (map[aclID]string, error) {
 
 	for rows.Next() {
 		var s string
-		var c sql.NullString
-		if err := rows.Scan(&s, &c); err != nil {
+		var c, sched sql.NullString
+		var from, until sql.NullInt64
+		if err := rows.Scan(&s, &c, &sched, &from, &until); err != nil {
 			return nil, err
 		}
-		acls[aclID(s)] = c.String
+		acls[aclID(s)] = groupACL{
+			Comment:  c.String,
+			Schedule: sched.String,
+			validity: newValidity(from, until),
+		}
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -637,7 +882,13 @@ func getGroupACLs(g groupID) (map[aclID]string, error) {
 	return acls, nil
 }
 
-func getGroupSources(g groupID) (map[sourceID]string, error) {
+// groupSource is a member of a group.
+type groupSource struct {
+	Comment string
+	validity
+}
+
+func getGroupSources(g groupID) (map[sourceID]groupSource, error) {
 	// First see if it exists.
 	{
 		var t string
@@ -656,9 +907,9 @@ func getGroupSources(g groupID) (map[sourceID]string, error) {
 		}
 	}
 
-	sources := make(map[sourceID]string)
+	sources := make(map[sourceID]groupSource)
 
-	rows, err := db.Query(`SELECT source_id, comment FROM members WHERE group_id=?`, string(g))
+	rows, err := db.Query(`SELECT source_id, comment, valid_from, valid_until FROM members WHERE group_id=?`, string(g))
 	if err != nil {
 		return nil, err
 	}
@@ -667,10 +918,14 @@ func getGroupSources(g groupID) (map[sourceID]string, error) {
 	for rows.Next() {
 		var s string
 		var c sql.NullString
-		if err := rows.Scan(&s, &c); err != nil {
+		var from, until sql.NullInt64
+		if err := rows.Scan(&s, &c, &from, &until); err != nil {
 			return nil, err
 		}
-		sources[sourceID(s)] = c.String
+		sources[sourceID(s)] = groupSource{
+			Comment:  c.String,
+			validity: newValidity(from, until),
+		}
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -680,7 +935,7 @@ func getGroupSources(g groupID) (map[sourceID]string, error) {
 
 func getACLs() ([]acl, error) {
 	var acls []acl
-	rows, err := db.Query(`SELECT acl_id, comment FROM acls ORDER BY comment`)
+	rows, err := db.Query(`SELECT acl_id, comment, priority FROM acls ORDER BY comment`)
 	if err != nil {
 		return nil, err
 	}
@@ -689,12 +944,14 @@ func getACLs() ([]acl, error) {
 	for rows.Next() {
 		var s string
 		var c sql.NullString
-		if err := rows.Scan(&s, &c); err != nil {
+		var p int
+		if err := rows.Scan(&s, &c, &p); err != nil {
 			return nil, err
 		}
 		e := acl{
-			ACLID:   aclID(s),
-			Comment: c.String,
+			ACLID:    aclID(s),
+			Comment:  c.String,
+			Priority: p,
 		}
 		acls = append(acls, e)
 	}
@@ -823,7 +1080,56 @@ func groupDeleteHandler(r *http.Request) (interface{}, error) {
 				code:     http.StatusInternalServerError,
 			}
 		}
-		return nil
+		_, err := tx.Exec(`DELETE FROM monitor_log WHERE group_id=?`, string(id))
+		return err
+	})
+}
+
+// groupDefaultHandler sets what to do for members of a group when no rule
+// matches. Empty means the global default.
+func groupDefaultHandler(r *http.Request) (interface{}, error) {
+	id := assertGroupID(mux.Vars(r)["groupID"])
+	var a sql.NullString
+	switch v := r.FormValue("action"); v {
+	case "":
+	case actionAllow, actionBlock:
+		a = sql.NullString{String: v, Valid: true}
+	default:
+		return nil, errHTTP{
+			external: fmt.Sprintf("bad default action %q", v),
+			code:     http.StatusBadRequest,
+		}
+	}
+	log.Printf("Setting default action of group %s to %q", id, a.String)
+	return "OK", txWrap(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE groups SET default_action=? WHERE group_id=?`, a, string(id))
+		return err
+	})
+}
+
+// getDefaultAction returns the global default action, for groups without
+// one.
+func getDefaultAction() (string, error) {
+	var a string
+	err := db.QueryRow(`SELECT value FROM settings WHERE name='default_action'`).Scan(&a)
+	if err == sql.ErrNoRows {
+		return actionBlock, nil
+	}
+	return a, err
+}
+
+func defaultActionHandler(r *http.Request) (interface{}, error) {
+	v := r.FormValue("action")
+	if v != actionAllow && v != actionBlock {
+		return nil, errHTTP{
+			external: fmt.Sprintf("bad default action %q", v),
+			code:     http.StatusBadRequest,
+		}
+	}
+	log.Printf("Setting global default action to %q", v)
+	return "OK", txWrap(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT OR REPLACE INTO settings(name, value) VALUES('default_action', ?)`, v)
+		return err
 	})
 }
 
@@ -848,17 +1154,44 @@ func aclDeleteHandler(r *http.Request) (interface{}, error) {
 	})
 }
 
+// aclUpdateHandler changes the comment or priority of an ACL, or both.
 func aclUpdateHandler(r *http.Request) (interface{}, error) {
 	id := assertSourceID(mux.Vars(r)["aclID"])
+	r.ParseForm()
+	_, setComment := r.Form["comment"]
+	_, setPriority := r.Form["priority"]
 	comment := r.FormValue("comment")
-	if len(comment) == 0 {
+	if setComment && len(comment) == 0 {
 		return nil, errHTTP{external: "comment may not be empty", code: http.StatusBadRequest}
 	}
+	var priority int
+	if setPriority {
+		var err error
+		priority, err = strconv.Atoi(r.FormValue("priority"))
+		if err != nil {
+			return nil, errHTTP{
+				internal: err,
+				external: fmt.Sprintf("invalid priority %q", r.FormValue("priority")),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+	if !setComment && !setPriority {
+		return nil, errHTTP{external: "nothing to update", code: http.StatusBadRequest}
+	}
 	log.Printf("Updating ACL %s", id)
 	return "OK", txWrap(func(tx *sql.Tx) error {
-		if _, err := tx.Exec(`UPDATE acls SET comment=? WHERE acl_id=?`, comment, string(id)); err != nil {
-			log.Printf("Failed to update comment for %v: %v", id, err)
-			return err
+		if setComment {
+			if _, err := tx.Exec(`UPDATE acls SET comment=? WHERE acl_id=?`, comment, string(id)); err != nil {
+				log.Printf("Failed to update comment for %v: %v", id, err)
+				return err
+			}
+		}
+		if setPriority {
+			if _, err := tx.Exec(`UPDATE acls SET priority=? WHERE acl_id=?`, priority, string(id)); err != nil {
+				log.Printf("Failed to update priority for %v: %v", id, err)
+				return err
+			}
 		}
 		return nil
 	})
@@ -915,6 +1248,10 @@ func membersmembersHandler(r *http.Request) (interface{}, error) {
 		return nil, err
 	}
 	comments := []string(r.Form["comments[]"])
+	valids, err := formValidities(r.Form["valid_froms[]"], r.Form["valid_untils[]"], len(sources))
+	if err != nil {
+		return nil, err
+	}
 
 	log.Printf("Updating group %s to %v", gid, sources)
 	return "OK", txWrap(func(tx *sql.Tx) error {
@@ -922,7 +1259,7 @@ func membersmembersHandler(r *http.Request) (interface{}, error) {
 			return err
 		}
 		for n := range sources {
-			if _, err := tx.Exec(`INSERT INTO members(group_id, source_id, comment) VALUES(?,?,?)`, string(gid), sources[n], comments[n]); err != nil {
+			if _, err := tx.Exec(`INSERT INTO members(group_id, source_id, comment, valid_from, valid_until) VALUES(?,?,?,?,?)`, string(gid), sources[n], comments[n], nullTime(valids[n].ValidFrom), nullTime(valids[n].ValidUntil)); err != nil {
 				return err
 			}
 		}
@@ -944,6 +1281,9 @@ func ruleDeleteHandler(r *http.Request) (interface{}, error) {
 		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM rules WHERE rule_id IN ('%s')`, strings.Join(rules, "','"))); err != nil {
 			return err
 		}
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM rule_hits WHERE rule_id IN ('%s')`, strings.Join(rules, "','"))); err != nil {
+			return err
+		}
 		return nil
 	})
 }
@@ -964,6 +1304,9 @@ func ruleEditHandler(r *http.Request) (interface{}, error) {
 		value:   r.FormValue("value"),
 		comment: r.FormValue("comment"),
 	}
+	if err := validateRule(data.typ, data.value); err != nil {
+		return nil, err
+	}
 	log.Printf("Updating %q with %+v", ruleID, data)
 	return "OK", txWrap(func(tx *sql.Tx) error {
 		_, err := tx.Exec(`UPDATE rules SET type=?, value=?, action=?, comment=? WHERE rule_id=?`, data.typ, data.value, data.action, data.comment, string(ruleID))
@@ -971,6 +1314,23 @@ func ruleEditHandler(r *http.Request) (interface{}, error) {
 	})
 }
 
+func ruleMethodsHandler(r *http.Request) (interface{}, error) {
+	id := assertRuleID(mux.Vars(r)["ruleID"])
+	methods, err := normalizeMethods(r.FormValue("methods"))
+	if err != nil {
+		return nil, errHTTP{
+			internal: err,
+			external: err.Error(),
+			code:     http.StatusBadRequest,
+		}
+	}
+	log.Printf("Setting methods of %s to %q", id, methods)
+	return "OK", txWrap(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE rules SET methods=? WHERE rule_id=?`, sql.NullString{String: methods, Valid: methods != ""}, string(id))
+		return err
+	})
+}
+
 func ruleListHandler(r *http.Request) (template.HTML, error) {
 	return "TODO", nil
 }
@@ -988,8 +1348,9 @@ func ruleHandler(r *http.Request) (template.HTML, error) {
 	}
 
 	// Load rule.
-	var c sql.NullString
-	if err := db.QueryRow(`SELECT type, value, action, comment FROM rules WHERE rule_id=? `, string(current)).Scan(&data.Current.Type, &data.Current.Value, &data.Current.Action, &c); err == sql.ErrNoRows {
+	var c, m sql.NullString
+	var from, until sql.NullInt64
+	if err := db.QueryRow(`SELECT type, value, action, comment, methods, valid_from, valid_until FROM rules WHERE rule_id=? `, string(current)).Scan(&data.Current.Type, &data.Current.Value, &data.Current.Action, &c, &m, &from, &until); err == sql.ErrNoRows {
 		return "", errHTTP{
 			external: "rule not found",
 			code:     http.StatusNotFound,
@@ -998,6 +1359,8 @@ func ruleHandler(r *http.Request) (template.HTML, error) {
 		return "", err
 	}
 	data.Current.Comment = c.String
+	data.Current.Methods = m.String
+	data.Current.validity = newValidity(from, until)
 
 	// Load ACLs.
 	rows, err := db.Query(`
@@ -1107,12 +1470,15 @@ func aclHandler(r *http.Request) (template.HTML, error) {
 		Rules   []rule
 		Actions []string
 		Types   []string
+
+		// Only show rules not hit in this many days, if set.
+		Stale int
 	}{
-		Actions: []string{actionAllow, actionIgnore},
-		Types:   []string{typeDomain, typeHTTPSDomain, typeRegex, typeHTTPSRegex, typeExact},
+		Actions: []string{actionAllow, actionIgnore, actionBlock},
+		Types:   []string{typeDomain, typeHTTPSDomain, typeRegex, typeHTTPSRegex, typeExact, typePathPrefix, typeHostGlob, typeSNI, typeCertName},
 	}
 	{
-		rows, err := db.Query(`SELECT acl_id, comment FROM acls ORDER BY comment`)
+		rows, err := db.Query(`SELECT acl_id, comment, priority FROM acls ORDER BY comment`)
 		if err != nil {
 			return "", err
 		}
@@ -1121,12 +1487,14 @@ func aclHandler(r *http.Request) (template.HTML, error) {
 		for rows.Next() {
 			var s string
 			var c sql.NullString
-			if err := rows.Scan(&s, &c); err != nil {
+			var p int
+			if err := rows.Scan(&s, &c, &p); err != nil {
 				return "", err
 			}
 			e := acl{
-				ACLID:   aclID(s),
-				Comment: c.String,
+				ACLID:    aclID(s),
+				Comment:  c.String,
+				Priority: p,
 			}
 			if current == e.ACLID {
 				data.Current = e
@@ -1138,12 +1506,26 @@ func aclHandler(r *http.Request) (template.HTML, error) {
 		}
 	}
 
+	if s := r.FormValue("stale"); s != "" {
+		var err error
+		if data.Stale, err = strconv.Atoi(s); err != nil || data.Stale < 0 {
+			return "", errHTTP{
+				internal: err,
+				external: fmt.Sprintf("invalid number of days %q", s),
+				code:     http.StatusBadRequest,
+			}
+		}
+	}
+
 	if len(current) > 0 {
-		r, err := loadACL(current)
+		rules, err := loadACL(current)
 		if err != nil {
 			return "", err
 		}
-		data.Rules = r
+		if data.Stale > 0 {
+			rules = staleRules(rules, time.Now().Add(-time.Duration(data.Stale)*24*time.Hour))
+		}
+		data.Rules = rules
 	}
 
 	tmpl := getTemplate("acl.html", template.FuncMap{"aclIDEQ": func(a, b aclID) bool { return a == b }})
@@ -1173,9 +1555,10 @@ func loadACL(id aclID) ([]rule, error) {
 		}
 	}
 	rows, err := db.Query(`
-SELECT rules.rule_id, rules.type, rules.value, rules.action, rules.comment
+SELECT rules.rule_id, rules.type, rules.value, rules.action, rules.comment, rules.valid_from, rules.valid_until, rule_hits.hits, rule_hits.last_hit
 FROM aclrules
 JOIN rules ON aclrules.rule_id=rules.rule_id
+LEFT JOIN rule_hits ON rules.rule_id=rule_hits.rule_id
 WHERE aclrules.acl_id=?
 ORDER BY rules.comment, rules.type, rules.value`, string(id))
 	if err != nil {
@@ -1188,11 +1571,18 @@ ORDER BY rules.comment, rules.type, rules.value`, string(id))
 		var e rule
 		var s string
 		var c sql.NullString
-		if err := rows.Scan(&s, &e.Type, &e.Value, &e.Action, &c); err != nil {
+		var from, until, hits, last sql.NullInt64
+		if err := rows.Scan(&s, &e.Type, &e.Value, &e.Action, &c, &from, &until, &hits, &last); err != nil {
 			return nil, err
 		}
 		e.RuleID = ruleID(s)
 		e.Comment = c.String
+		e.validity = newValidity(from, until)
+		e.Hits = hits.Int64
+		if last.Valid {
+			e.lastHit = time.Unix(last.Int64, 0)
+			e.LastHit = e.lastHit.UTC().Format(saneTime)
+		}
 		rules = append(rules, e)
 	}
 	if err := rows.Err(); err != nil {
@@ -1202,6 +1592,17 @@ ORDER BY rules.comment, rules.type, rules.value`, string(id))
 	return rules, nil
 }
 
+// staleRules returns the rules not hit since t.
+func staleRules(rules []rule, t time.Time) []rule {
+	var ret []rule
+	for _, r := range rules {
+		if r.lastHit.Before(t) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
 type logEntry struct {
 	Time   string
 	Client string
@@ -1210,13 +1611,17 @@ type logEntry struct {
 	Host   string
 	Path   string
 	URL    string
+	User   string
+
+	// Time, in local time.
+	t time.Time
 }
 
 var errSkip = errors.New("skip this one, don't log")
 
 func parseLogEntry(l string) (*logEntry, error) {
-	//                        time        ms    client     DENIED    size   method  URL           HIER    type
-	re := regexp.MustCompile(`([0-9.]+)\s+\d+\s+([^\s]+)\s+([^\s]+)\s+\d+\s+(\w+)\s+([^\s]+)\s+-\s[^\s]+\s([^\s]+)`)
+	//                        time        ms    client     DENIED    size   method  URL       user      HIER    type
+	re := regexp.MustCompile(`([0-9.]+)\s+\d+\s+([^\s]+)\s+([^\s]+)\s+\d+\s+(\w+)\s+([^\s]+)\s+([^\s]+)\s[^\s]+\s([^\s]+)`)
 	if len(l) == 0 {
 		return nil, errSkip
 	}
@@ -1244,14 +1649,21 @@ func parseLogEntry(l string) (*logEntry, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse epoch time %q: %v", s[1], err)
 	}
+	t := time.Unix(int64(ts), int64(1e9*(ts-math.Trunc(ts))))
+	user := s[6]
+	if user == "-" {
+		user = ""
+	}
 	return &logEntry{
-		Time:   time.Unix(int64(ts), int64(1e9*(ts-math.Trunc(ts)))).UTC().Format(saneTime),
+		t:      t,
+		Time:   t.UTC().Format(saneTime),
 		Client: s[2],
 		Method: s[4],
 		Domain: host2domain(host),
 		Host:   host,
 		Path:   p,
 		URL:    u,
+		User:   user,
 	}, nil
 }
 
@@ -1312,14 +1724,19 @@ func makeRouter() *mux.Router {
 	rdelete := r.Methods("DELETE").Headers("X-Requested-With", "XMLHttpRequest").Subrouter()
 
 	u := uuidRE
-	r.HandleFunc("/ajax/tail-log", tailLogHandler).Methods("GET")
+	r.Handle("/ajax/tail-log", countRoute("/ajax/tail-log", http.HandlerFunc(tailLogHandler))).Methods("GET")
 	r.HandleFunc("/ajax/tail-log/stream", tailHandler)
 
-	rget.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(&myDir{*staticDir})))
-	rget.HandleFunc("/proxy.pac", pacHandler)
+	rget.PathPrefix("/static/").Handler(countRoute("/static/", http.StripPrefix("/static/", http.FileServer(&myDir{*staticDir}))))
+	rget.Handle("/proxy.pac", countRoute("/proxy.pac", http.HandlerFunc(pacHandler)))
+	rget.Handle("/blocked", countRoute("/blocked", http.HandlerFunc(blockedHandler)))
+	rget.Handle("/request-access/{requestID:"+u+"}", countRoute("/request-access/{requestID:"+u+"}", http.HandlerFunc(requestStatusHandler)))
+	r.Handle("/request-access", countRoute("/request-access", http.HandlerFunc(requestAccessHandler))).Methods("POST")
+	rget.Handle("/metrics", metrics.Default)
 	pg := "{groupID:" + u + "}"
 	pa := "{aclID:" + u + "}"
 	pr := "{ruleID:" + u + "}"
+	pq := "{requestID:" + u + "}"
 	ps := "{sourceID:" + u + "}"
 
 	for _, e := range []struct {
@@ -1343,7 +1760,13 @@ func makeRouter() *mux.Router {
 		{path.Join("/acl/move"), true, rpost, aclMoveHandler},
 		{path.Join("/acl/new"), true, rpost, aclNewHandler},
 
+		{path.Join("/default"), true, rpost, defaultActionHandler},
+
+		{path.Join("/explain") + "/", false, rget, explainHandler},
+
 		{path.Join("/group/", pg), true, rdelete, groupDeleteHandler},
+		{path.Join("/group/", pg, "default"), true, rpost, groupDefaultHandler},
+		{path.Join("/group/", pg, "monitor"), true, rpost, groupMonitorHandler},
 		{path.Join("/group/new"), true, rpost, groupNewHandler},
 
 		{path.Join("/members") + "/", false, rget, membersHandler},
@@ -1351,20 +1774,36 @@ func makeRouter() *mux.Router {
 		{path.Join("/members/", pg, "members"), true, rpost, membersmembersHandler},
 		{path.Join("/members/", pg, "new"), true, rpost, membersNewHandler},
 
+		{path.Join("/monitor") + "/", false, rget, monitorHandler},
+		{path.Join("/monitor/", pg), false, rget, monitorHandler},
+		{path.Join("/monitor/", pg, "acl"), true, rpost, monitorACLHandler},
+		{path.Join("/monitor/", pg, "clear"), true, rpost, monitorClearHandler},
+
+		{path.Join("/replay") + "/", false, rget, replayHandler},
+		{path.Join("/replay/run"), true, rpost, replayRunHandler},
+
+		{path.Join("/requests") + "/", false, rget, requestsHandler},
+		{path.Join("/requests/", pq, "approve"), true, rpost, requestApproveHandler},
+		{path.Join("/requests/", pq, "reject"), true, rpost, requestRejectHandler},
+
 		{path.Join("/rule/") + "/", false, rget, ruleHandler},
 		{path.Join("/rule/", pr), false, rget, ruleHandler},
 		{path.Join("/rule/", pr), true, rpost, ruleEditHandler},
+		{path.Join("/rule/", pr, "methods"), true, rpost, ruleMethodsHandler},
+		{path.Join("/rule/", pr, "validity"), true, rpost, ruleValidityHandler},
 		{path.Join("/rule/new"), true, rpost, ruleNewHandler},
 		{path.Join("/rule/delete"), true, rpost, ruleDeleteHandler},
 
 		{path.Join("/source/", ps), false, rget, sourceHandler},
 		{path.Join("/source/", ps), true, rdelete, sourceDeleteHandler},
 	} {
+		var h http.HandlerFunc
 		if e.js {
-			e.r.HandleFunc(e.path, errWrapJSON(e.handler.(func(*http.Request) (interface{}, error))))
+			h = errWrapJSON(e.handler.(func(*http.Request) (interface{}, error)))
 		} else {
-			e.r.HandleFunc(e.path, errWrap(e.handler.(func(*http.Request) (template.HTML, error))))
+			h = errWrap(e.handler.(func(*http.Request) (template.HTML, error)))
 		}
+		e.r.Handle(e.path, countRoute(e.path, h))
 	}
 	return r
 }
@@ -1391,8 +1830,26 @@ func (c hstsAdder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func main() {
 	flag.Parse()
 	if flag.NArg() > 0 {
-		log.Fatalf("Extra args on cmdline: %q", flag.Args())
+		var err error
+		switch flag.Arg(0) {
+		case "explain":
+			err = explainMain(flag.Args()[1:])
+		case "replay":
+			err = replayMain(flag.Args()[1:])
+		default:
+			log.Fatalf("Extra args on cmdline: %q", flag.Args())
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	tp, err := parseTrustedProxies(*trustedList)
+	if err != nil {
+		log.Fatal(err)
 	}
+	trustedProxies = tp
 
 	if _, err := readFile(path.Join(*staticDir, "loading.gif")); err != nil {
 		log.Fatalf("Couldn't find 'loading.gif'. Did you 'go generate'? -mem_files=%t -disk_files=%t -static=%q", *memFiles, *diskFiles, *staticDir)
@@ -1417,6 +1874,9 @@ func main() {
 	}
 
 	openDB()
+	if *archiveAfter >= 0 {
+		go archiver()
+	}
 
 	var h http.Handler
 	{
@@ -1,7 +1,21 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/squidwarden/policy"
+	"github.com/gorilla/mux"
 )
 
 func TestParseLogEntry(t *testing.T) {
@@ -43,12 +57,29 @@ func TestParseLogEntry(t *testing.T) {
 				URL:    "shell.habets.se:22",
 			},
 		},
+		{
+			"1451606400 10 10.0.0.1 DENIED 100 GET http://blog.habets.se/ alice HIER/- foo/bar",
+			logEntry{
+				Time:   "2016-01-01 00:00:00 UTC",
+				Client: "10.0.0.1",
+				Method: "GET",
+				Domain: ".habets.se",
+				Host:   "blog.habets.se",
+				Path:   "/",
+				URL:    "http://blog.habets.se/",
+				User:   "alice",
+			},
+		},
 	} {
 		got, err := parseLogEntry(test.in)
 		if err != nil {
 			t.Errorf("Failed to parse %q: %v", test.in, err)
 			continue
 		}
+		if !got.t.Equal(time.Unix(1451606400, 0)) {
+			t.Errorf("%q: got time %v", test.in, got.t)
+		}
+		got.t = time.Time{}
 		if *got != test.want {
 			t.Errorf("%q: got %+v, want %+v", test.in, *got, test.want)
 		}
@@ -74,3 +105,607 @@ func TestHost2Domain(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalizeMethods(t *testing.T) {
+	for _, test := range []struct {
+		in, out string
+		err     bool
+	}{
+		{"", "", false},
+		{"GET", "GET", false},
+		{"head, get", "GET,HEAD", false},
+		{"POST PUT,POST", "POST,PUT", false},
+		{"GET;", "", true},
+		{"GE T/", "", true},
+	} {
+		got, err := normalizeMethods(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got err %v, want err %t", test.in, err, test.err)
+		} else if got != test.out {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.out)
+		}
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	for _, test := range []struct {
+		typ, value string
+		ok         bool
+	}{
+		{typeHostGlob, "*.blob.core.windows.net", true},
+		{typeHostGlob, "updates-*.vendor.com:8443", true},
+		{typeHostGlob, "**.example.com:*", true},
+		{typeHostGlob, "*.example.com:http", false},
+		{typeHostGlob, "*.example.com:99999", false},
+		{typeHostGlob, "***.example.com", false},
+		{typeHostGlob, ".example.com", false},
+		{typeDomain, ".example.com", true},
+		{typeSNI, "www.example.com", true},
+		{typeSNI, ".example.com", true},
+		{typeSNI, "www.example.com:443", false},
+		{typeCertName, "10.0.0.0/8", false},
+		{typeCertName, ".", false},
+		{typePathPrefix, "www.example.com/docs/", true},
+		{typePathPrefix, "http://.example.com:8080/a%20b", true},
+		{typePathPrefix, "/docs/", false},
+		{typePathPrefix, "www.example.com/a%zz", false},
+		{typePathPrefix, "https://www.example.com/docs/", false},
+		{typeRegex, "http://www\\.example\\.com/.*", true},
+		{typeRegex, "http://(www\\.example\\.com/.*", false},
+		{typeHTTPSRegex, "[", false},
+	} {
+		if err := validateRule(test.typ, test.value); (err == nil) != test.ok {
+			t.Errorf("%s %q: got %v, want ok=%t", test.typ, test.value, err, test.ok)
+		}
+	}
+}
+
+func TestStaleRules(t *testing.T) {
+	now := time.Now()
+	rules := []rule{
+		{RuleID: "never"},
+		{RuleID: "old", lastHit: now.Add(-48 * time.Hour)},
+		{RuleID: "new", lastHit: now.Add(-time.Hour)},
+	}
+	var got []ruleID
+	for _, r := range staleRules(rules, now.Add(-24*time.Hour)) {
+		got = append(got, r.RuleID)
+	}
+	if want := []ruleID{"never", "old"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseBlockInfo(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		in   string
+		want blockInfo
+	}{
+		{
+			"url=http%3A%2F%2Fmail.google.com%2F&client=10.0.0.1&user=-&reason=Blocked+by+rule+r1&time=Sat,+02+Jan+2016+10:00:00+GMT",
+			blockInfo{
+				URL:    "http://mail.google.com/",
+				Client: "10.0.0.1",
+				Reason: "Blocked by rule r1",
+				Time:   "2016-01-02 10:00:00 UTC",
+			},
+		},
+		{
+			"url=example.com%3A443&user=alice&time=bogus",
+			blockInfo{
+				URL:  "example.com:443",
+				User: "alice",
+				Time: "2016-01-01 12:00:00 UTC",
+			},
+		},
+		{
+			"",
+			blockInfo{Time: "2016-01-01 12:00:00 UTC"},
+		},
+	} {
+		q, err := url.ParseQuery(test.in)
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if got := parseBlockInfo(q, now); got != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSuggestRule(t *testing.T) {
+	for _, test := range []struct {
+		in, typ, value string
+	}{
+		{"http://www.Example.com/foo?bar", typeDomain, "www.example.com"},
+		{"http://www.example.com:80/", typeDomain, "www.example.com"},
+		{"http://www.example.com:8080/", typeDomain, "www.example.com:8080"},
+		{"www.example.com:443", typeHTTPSDomain, "www.example.com"},
+		{"shell.example.com:22", typeHTTPSDomain, "shell.example.com:22"},
+	} {
+		typ, value := suggestRule(test.in)
+		if typ != test.typ || value != test.value {
+			t.Errorf("%q: got %q %q, want %q %q", test.in, typ, value, test.typ, test.value)
+		}
+	}
+}
+
+func TestRequestClient(t *testing.T) {
+	trusted, err := parseTrustedProxies("127.0.0.1, 10.1.0.0/24,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remote string
+		fwd    []string
+		want   string
+	}{
+		{"10.0.0.5:1234", nil, "10.0.0.5"},
+		{"10.0.0.5:1234", []string{"10.9.9.9"}, "10.0.0.5"},
+		{"127.0.0.1:1234", nil, "127.0.0.1"},
+		{"127.0.0.1:1234", []string{"10.0.0.5"}, "10.0.0.5"},
+		{"[::1]:1234", []string{"10.0.0.5"}, "10.0.0.5"},
+		{"127.0.0.1:1234", []string{"10.9.9.9, 10.0.0.5, 10.1.0.7"}, "10.0.0.5"},
+		{"127.0.0.1:1234", []string{"10.9.9.9", "10.0.0.5"}, "10.0.0.5"},
+		{"127.0.0.1:1234", []string{"10.1.0.8, 10.1.0.7"}, "10.1.0.8"},
+		{"10.0.0.5", nil, "10.0.0.5"},
+	} {
+		r := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		for _, f := range test.fwd {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := requestClient(r, trusted); got != test.want {
+			t.Errorf("%s %q: got %q, want %q", test.remote, test.fwd, got, test.want)
+		}
+	}
+	for _, bad := range []string{"localhost", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestParseValidity(t *testing.T) {
+	now := time.Date(2016, 1, 4, 12, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		from, until string
+		want        validity
+		err         bool
+	}{
+		{"", "", validity{}, false},
+		{"", "+7d", validity{ValidUntil: now.AddDate(0, 0, 7).Unix()}, false},
+		{"+1h30m", "", validity{ValidFrom: now.Add(90 * time.Minute).Unix()}, false},
+		{"2016-01-05", "2016-01-08 17:00", validity{
+			ValidFrom:  time.Date(2016, 1, 5, 0, 0, 0, 0, time.Local).Unix(),
+			ValidUntil: time.Date(2016, 1, 8, 17, 0, 0, 0, time.Local).Unix(),
+		}, false},
+		{"2016-01-08", "2016-01-05", validity{}, true},
+		{"", "+-1d", validity{}, true},
+		{"", "friday", validity{}, true},
+	} {
+		got, err := parseValidity(test.from, test.until, now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q-%q: want error, got %+v", test.from, test.until, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q-%q: %v", test.from, test.until, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q-%q: got %+v, want %+v", test.from, test.until, got, test.want)
+		}
+	}
+}
+
+func TestCountdown(t *testing.T) {
+	now := time.Unix(1451606400, 0)
+	t0 := now.Unix()
+	for _, test := range []struct {
+		v    validity
+		want string
+	}{
+		{validity{}, ""},
+		{validity{ValidFrom: t0 - 10}, ""},
+		{validity{ValidFrom: t0 + 90}, "starts in 1m 30s"},
+		{validity{ValidUntil: t0 + 7*86400 + 3*3600}, "expires in 7d 3h"},
+		{validity{ValidUntil: t0 + 2*3600 + 5*60}, "expires in 2h 5m"},
+		{validity{ValidUntil: t0 + 5}, "expires in 5s"},
+		{validity{ValidUntil: t0}, "expired"},
+	} {
+		if got := countdown(test.v, now); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.v, got, test.want)
+		}
+	}
+}
+
+func TestExplainRequest(t *testing.T) {
+	for _, test := range []struct {
+		proto, method, uri string
+		wantProto          string
+		wantMethod         string
+	}{
+		{"", "", "http://www.example.com/", "HTTP", "GET"},
+		{"", "connect", "www.example.com:443", "NONE", "CONNECT"},
+		{"http", "POST", "http://www.example.com/", "HTTP", "POST"},
+		{"NONE", "GET", "https://www.example.com/", "NONE", "GET"},
+	} {
+		r := explainRequest(test.proto, " 10.0.0.7 ", test.method, test.uri, "")
+		if r.Proto != test.wantProto || r.Method != test.wantMethod || r.Src != "10.0.0.7" || r.URI != test.uri {
+			t.Errorf("%q %q %q: got %+v", test.proto, test.method, test.uri, r)
+		}
+	}
+}
+
+func TestParseReplayLine(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want policy.Request
+	}{
+		{
+			"1451606400 10 10.0.0.1 DENIED 100 CONNECT blog.habets.se:443 - HIER/- foo/bar",
+			policy.Request{Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: "blog.habets.se:443", Time: time.Unix(1451606400, 0)},
+		},
+		{
+			"1451606400 10 10.0.0.1 DENIED 100 CONNECT blog.habets.se:443 alice HIER/- foo/bar",
+			policy.Request{Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: "blog.habets.se:443", User: "alice", Time: time.Unix(1451606400, 0)},
+		},
+		{
+			`{"time":"2016-01-01T00:00:00Z","channel":"7","src":"10.0.0.1","user":"alice","proto":"HTTP","method":"GET","uri":"http://blog.habets.se/","action":"block","latency_us":3}`,
+			policy.Request{Proto: "HTTP", Src: "10.0.0.1", Method: "GET", URI: "http://blog.habets.se/", User: "alice", Time: time.Unix(1451606400, 0)},
+		},
+		{
+			`{"time":"2016-01-01T00:00:00Z","channel":"7","src":"10.0.0.1","proto":"NONE","method":"CONNECT","uri":"192.0.2.1:443","sni":"blog.habets.se","cert_names":["blog.habets.se"],"action":"block","latency_us":3}`,
+			policy.Request{Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: "192.0.2.1:443", SNI: "blog.habets.se", CertNames: []string{"blog.habets.se"}, Time: time.Unix(1451606400, 0)},
+		},
+	} {
+		got, err := parseReplayLine(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if !got.Time.Equal(test.want.Time) {
+			t.Errorf("%q: got time %v, want %v", test.in, got.Time, test.want.Time)
+		}
+		got.Time = test.want.Time
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.in, *got, test.want)
+		}
+	}
+	for _, in := range []string{"garbage", "{bad json"} {
+		if _, err := parseReplayLine(in); err == nil {
+			t.Errorf("%q: want error", in)
+		} else if strings.Contains(err.Error(), in) {
+			t.Errorf("%q: error %q quotes the line", in, err)
+		}
+	}
+
+	// Squid logs are in epoch time, and schedules apply in local time.
+	defer func(l *time.Location) { time.Local = l }(time.Local)
+	time.Local = time.FixedZone("UTC+5", 5*3600)
+	got, err := parseReplayLine("1451606400 10 10.0.0.1 DENIED 100 GET http://a/ - HIER/- foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Time.Location() != time.Local || got.Time.Hour() != 5 {
+		t.Errorf("got time %v, want 05:00 local", got.Time)
+	}
+}
+
+func TestCheckChanges(t *testing.T) {
+	for _, test := range []struct {
+		sql string
+		ok  bool
+	}{
+		{"DELETE FROM groupaccess WHERE group_id='kids';", true},
+		{"UPDATE rules SET comment='attach it; vacuum' WHERE rule_id=\"pragma\"; -- ATTACH\n/* PRAGMA */", true},
+		{"INSERT INTO rules(rule_id) VALUES('it''s');", true},
+		{"ATTACH DATABASE '/tmp/x' AS x", false},
+		{"delete from rules; vacuum into '/tmp/x'", false},
+		{"PRAGMA writable_schema=1", false},
+		{"/* */ Detach x", false},
+		{"SELECT 'unterminated", false},
+	} {
+		if err := checkChanges(test.sql); (err == nil) != test.ok {
+			t.Errorf("%q: got %v, want ok=%t", test.sql, err, test.ok)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tdb, err := sql.Open("sqlite3", path.Join(dir, "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	for _, fn := range []string{"../../sqlite.schema", "../../testdata/test.sql"} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tdb.Exec(string(b)); err != nil {
+			t.Fatalf("%s: %v", fn, err)
+		}
+	}
+	current, err := policy.Load(tdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the block rule, the allow rule for .google.com applies.
+	if _, err := tdb.Exec(`DELETE FROM aclrules WHERE rule_id='kw2'`); err != nil {
+		t.Fatal(err)
+	}
+	candidate, err := policy.Load(tdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := strings.Join([]string{
+		"1451606400 10 127.0.0.3 DENIED 100 GET http://mail.google.com/ - HIER/- foo/bar",
+		"1451606401 10 127.0.0.3 DENIED 100 GET http://mail.google.com/inbox - HIER/- foo/bar",
+		"1451606402 10 127.0.0.1 DENIED 100 GET http://mail.google.com/ - HIER/- foo/bar",
+		`{"time":"2016-01-01T00:00:00Z","src":"127.0.0.3","proto":"NONE","method":"CONNECT","uri":"mail.google.com:443"}`,
+		"",
+		"garbage",
+	}, "\n")
+	rep, err := replay(strings.NewReader(log), current, candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &replayReport{
+		Lines:    6,
+		Replayed: 4,
+		Flipped:  2,
+		Flips: []replayFlip{
+			{Client: "127.0.0.3", Domain: ".google.com", From: "block", To: "allow", Count: 2, Example: "http://mail.google.com/"},
+		},
+		Bad:    1,
+		Errors: []string{"line 6: bad squid log line"},
+	}
+	if want := []string{"line 6: bad squid log line"}; !reflect.DeepEqual(rep.Errors, want) {
+		t.Errorf("got errors %q, want %q", rep.Errors, want)
+	}
+	if !reflect.DeepEqual(rep, want) {
+		t.Errorf("got %+v, want %+v", rep, want)
+	}
+}
+
+func TestReplayAsLogged(t *testing.T) {
+	done := useTestDB(t)
+	defer done()
+	// The block rule ended in 2017, after the requests but before now.
+	if _, err := db.Exec(`UPDATE rules SET valid_until=? WHERE rule_id='kw2'`, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	current, err := policy.Load(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidate, err := loadCandidate("", `DELETE FROM aclrules WHERE rule_id IN ('kw2', 'nocrule1')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := strings.Join([]string{
+		"1451606400 10 127.0.0.3 DENIED 100 GET http://mail.google.com/ - HIER/- foo/bar",
+		// Alice's own grant applies before the one for her address.
+		"1451606401 10 127.0.0.2 TCP_TUNNEL 100 CONNECT 9.10.0.1:443 alice HIER/- foo/bar",
+		"1451606402 10 127.0.0.2 TCP_TUNNEL 100 CONNECT 9.10.0.1:443 - HIER/- foo/bar",
+	}, "\n")
+	rep, err := replay(strings.NewReader(log), current, candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []replayFlip{
+		{Client: "127.0.0.2", Domain: "9.10.0.1", From: "allow", To: "ignore", Count: 1, Example: "9.10.0.1:443"},
+		{Client: "127.0.0.3", Domain: ".google.com", From: "block", To: "allow", Count: 1, Example: "http://mail.google.com/"},
+	}
+	if !reflect.DeepEqual(rep.Flips, want) {
+		t.Errorf("got %+v, want %+v", rep.Flips, want)
+	}
+}
+
+// useTestDB points db at a new database with the test policy, until the
+// returned func is called.
+func useTestDB(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb, err := sql.Open("sqlite3", path.Join(dir, "test.sqlite"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	old := db
+	db = tdb
+	done := func() {
+		db = old
+		tdb.Close()
+		os.RemoveAll(dir)
+	}
+	for _, fn := range []string{"../../sqlite.schema", "../../testdata/test.sql"} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			done()
+			t.Fatal(err)
+		}
+		if _, err := tdb.Exec(string(b)); err != nil {
+			done()
+			t.Fatalf("%s: %v", fn, err)
+		}
+	}
+	return done
+}
+
+func TestReplayMonitor(t *testing.T) {
+	done := useTestDB(t)
+	defer done()
+	tdb := db
+	if _, err := tdb.Exec(`UPDATE groups SET monitor=1 WHERE group_id='kids'`); err != nil {
+		t.Fatal(err)
+	}
+	current, err := policy.Load(tdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidate, err := loadCandidate("", `UPDATE groups SET monitor=0 WHERE group_id='kids'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := strings.Join([]string{
+		"1451606400 10 127.0.0.3 DENIED 100 GET http://mail.google.com/ - HIER/- foo/bar",
+		"1451606401 10 127.0.0.3 TCP_MISS 100 GET http://www.google.com/ - HIER/- foo/bar",
+	}, "\n")
+	rep, err := replay(strings.NewReader(log), current, candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []replayFlip{
+		{Client: "127.0.0.3", Domain: ".google.com", From: "block (monitored)", To: "block", Count: 1, Example: "http://mail.google.com/"},
+	}
+	if rep.Flipped != 1 || !reflect.DeepEqual(rep.Flips, want) {
+		t.Errorf("got %d flips %+v, want %+v", rep.Flipped, rep.Flips, want)
+	}
+}
+
+func TestHelperWarning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squidwarden_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "status.json")
+	if got := helperWarning(""); got != "" {
+		t.Errorf("no status file: got %q", got)
+	}
+	if got := helperWarning(fn); !strings.Contains(got, "Can't read") {
+		t.Errorf("missing status file: got %q", got)
+	}
+	// Not a helper's.
+	if err := ioutil.WriteFile(path.Join(dir, "status.old.json"), []byte(`{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		status []string
+		want   string
+	}{
+		{[]string{`{"state":"ok"}`}, ""},
+		{[]string{`{"state":"stale","error":"database is locked"}`}, "uses the last one it loaded"},
+		{[]string{`{"state":"snapshot","error":"file is not a database"}`}, "snapshot"},
+		{[]string{`{"state":"none","fail_mode":"open"}`}, "allows everything"},
+		{[]string{`{"state":"none","fail_mode":"closed"}`}, "blocks everything"},
+		{[]string{`{`}, "Bad helper status"},
+		{[]string{`{"state":"ok"}`, `{"state":"ok"}`}, ""},
+		{[]string{`{"state":"ok"}`, `{"state":"snapshot"}`, `{"state":"ok"}`}, "snapshot since"},
+		{[]string{`{"state":"ok"}`, `{"state":"snapshot"}`, `{"state":"ok"}`}, "1 of 3 helper processes"},
+		{[]string{`{"state":"none"}`, `{"state":"stale"}`}, "no policy"},
+		{[]string{`{"state":"stale"}`, `{"state":"none"}`}, "2 of 2 helper processes"},
+	} {
+		for n, st := range test.status {
+			if err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("status.%d.json", 100+n)), []byte(st), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := helperWarning(fn)
+		if (test.want == "") != (got == "") || !strings.Contains(got, test.want) {
+			t.Errorf("%s: got %q, want containing %q", test.status, got, test.want)
+		}
+		for n := range test.status {
+			os.Remove(path.Join(dir, fmt.Sprintf("status.%d.json", 100+n)))
+		}
+	}
+}
+
+// formRequest returns a POST of form with the mux variables vars.
+func formRequest(form url.Values, vars map[string]string) *http.Request {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return mux.SetURLVars(r, vars)
+}
+
+// aclHasRule returns true if the rule is in the ACL.
+func aclHasRule(t *testing.T, acl, rule string) bool {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM aclrules WHERE acl_id=? AND rule_id=?`, acl, rule).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n == 1
+}
+
+func TestMonitorACLExistingRule(t *testing.T) {
+	done := useTestDB(t)
+	defer done()
+	const g = "5b0b3bbd-3a14-4e43-9f5b-07e0f5fd9f06"
+	if _, err := db.Exec(`INSERT INTO groups(group_id, comment, monitor) VALUES(?, 'Kids', 1)`, g); err != nil {
+		t.Fatal(err)
+	}
+
+	// .google.com is already allowed by kw1, in kids-web.
+	resp, err := monitorACLHandler(formRequest(url.Values{
+		"sites[]":  {"http://www.google.com/", "http://example.org/"},
+		"types[]":  {"domain", "domain"},
+		"values[]": {".google.com", "example.org"},
+	}, map[string]string{"groupID": g}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := resp.(*struct {
+		ACL string `json:"acl"`
+	}).ACL
+	if !aclHasRule(t, acl, "kw1") {
+		t.Errorf("existing rule kw1 not added to the new ACL")
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM aclrules JOIN rules USING(rule_id) WHERE acl_id=? AND value='example.org' AND action='allow'`, acl).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("new rule for example.org: got %d, want 1", n)
+	}
+	if !aclHasRule(t, "kids-web", "kw1") {
+		t.Errorf("kw1 removed from kids-web")
+	}
+}
+
+func TestApproveExistingRule(t *testing.T) {
+	done := useTestDB(t)
+	defer done()
+	const (
+		id  = "0f0b9d3e-5c41-4b8e-a1a5-5f5d2a3c7e11"
+		acl = "88bf513a-802f-450d-9fc4-b49eeabf1b8f"
+	)
+	if _, err := db.Exec(`INSERT INTO acls(acl_id, comment) VALUES(?, 'Requested')`, acl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO access_requests(request_id, created, url, client, status) VALUES(?, 0, 'http://mail.google.com/', '127.0.0.3', ?)`, id, requestPending); err != nil {
+		t.Fatal(err)
+	}
+
+	// .google.com is already allowed by kw1, in kids-web.
+	if _, err := requestApproveHandler(formRequest(url.Values{
+		"type":  {"domain"},
+		"value": {".google.com"},
+		"acl":   {acl},
+	}, map[string]string{"requestID": id})); err != nil {
+		t.Fatal(err)
+	}
+	if !aclHasRule(t, acl, "kw1") {
+		t.Errorf("existing rule kw1 not added to the ACL")
+	}
+	var status, rule string
+	if err := db.QueryRow(`SELECT status, rule_id FROM access_requests WHERE request_id=?`, id).Scan(&status, &rule); err != nil {
+		t.Fatal(err)
+	}
+	if status != requestApproved || rule != "kw1" {
+		t.Errorf("got %s with rule %s, want %s with kw1", status, rule, requestApproved)
+	}
+}
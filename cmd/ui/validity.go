@@ -0,0 +1,300 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+// Rules, grants and memberships can be limited to a period of time. The helper
+// enforces it; here it's edited, shown, and expired entries archived.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Format for entering and showing validity times, in local time like
+	// schedules.
+	validityTime = "2006-01-02 15:04"
+
+	archiveInterval = time.Hour
+)
+
+var archiveAfter = flag.Duration("archive_after", 24*time.Hour, "Archive rules, grants and memberships this long after they expire. Negative disables.")
+
+// validity is when a rule, grant or membership is in effect, as Unix times.
+// Zero means no limit.
+type validity struct {
+	ValidFrom  int64
+	ValidUntil int64
+}
+
+func newValidity(from, until sql.NullInt64) validity {
+	return validity{ValidFrom: from.Int64, ValidUntil: until.Int64}
+}
+
+func formatValidity(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).Format(validityTime)
+}
+
+// From and Until are the times as shown in forms.
+func (v validity) From() string  { return formatValidity(v.ValidFrom) }
+func (v validity) Until() string { return formatValidity(v.ValidUntil) }
+
+// Countdown says when v starts or stops being in effect, if it does.
+func (v validity) Countdown() string { return countdown(v, time.Now()) }
+
+func (v validity) activeAt(now time.Time) bool {
+	t := now.Unix()
+	return (v.ValidFrom == 0 || v.ValidFrom <= t) && (v.ValidUntil == 0 || t < v.ValidUntil)
+}
+
+// Expired is true if v has stopped being in effect.
+func (v validity) Expired() bool {
+	return v.ValidUntil != 0 && v.ValidUntil <= time.Now().Unix()
+}
+
+func countdown(v validity, now time.Time) string {
+	t := now.Unix()
+	switch {
+	case v.ValidFrom > t:
+		return "starts in " + shortDuration(v.ValidFrom-t)
+	case v.ValidUntil == 0:
+		return ""
+	case v.ValidUntil <= t:
+		return "expired"
+	}
+	return "expires in " + shortDuration(v.ValidUntil-t)
+}
+
+// shortDuration formats seconds as the two largest units.
+func shortDuration(s int64) string {
+	switch {
+	case s >= 86400:
+		return fmt.Sprintf("%dd %dh", s/86400, s%86400/3600)
+	case s >= 3600:
+		return fmt.Sprintf("%dh %dm", s/3600, s%3600/60)
+	case s >= 60:
+		return fmt.Sprintf("%dm %ds", s/60, s%60)
+	}
+	return fmt.Sprintf("%ds", s)
+}
+
+// parseValidityTime parses a time as entered in a form: empty for no limit, a
+// local time in validityTime format or just a date, or relative to now, like
+// "+7d" or "+12h".
+func parseValidityTime(s string, now time.Time) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasPrefix(s, "+") {
+		rel := s[1:]
+		if strings.HasSuffix(rel, "d") {
+			n, err := strconv.Atoi(strings.TrimSuffix(rel, "d"))
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("bad number of days in %q", s)
+			}
+			return now.AddDate(0, 0, n).Unix(), nil
+		}
+		d, err := time.ParseDuration(rel)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		return now.Add(d).Unix(), nil
+	}
+	for _, f := range []string{validityTime, "2006-01-02"} {
+		if t, err := time.ParseInLocation(f, s, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("bad time %q, want e.g. %q or \"+7d\"", s, validityTime)
+}
+
+// parseValidity parses the valid from and until fields of a form.
+func parseValidity(from, until string, now time.Time) (validity, error) {
+	var v validity
+	var err error
+	if v.ValidFrom, err = parseValidityTime(from, now); err != nil {
+		return v, err
+	}
+	if v.ValidUntil, err = parseValidityTime(until, now); err != nil {
+		return v, err
+	}
+	if v.ValidFrom != 0 && v.ValidUntil != 0 && v.ValidUntil <= v.ValidFrom {
+		return v, fmt.Errorf("valid until %s is not after valid from %s", v.Until(), v.From())
+	}
+	return v, nil
+}
+
+// formValidity is parseValidity for handlers.
+func formValidity(from, until string) (validity, error) {
+	v, err := parseValidity(from, until, time.Now())
+	if err != nil {
+		return v, errHTTP{
+			internal: err,
+			external: err.Error(),
+			code:     http.StatusBadRequest,
+		}
+	}
+	return v, nil
+}
+
+// formValidities parses lists of valid from and until fields, which must
+// both have n entries.
+func formValidities(froms, untils []string, n int) ([]validity, error) {
+	if len(froms) != n || len(untils) != n {
+		return nil, fmt.Errorf("validity lists have the wrong length. want=%d from=%d until=%d", n, len(froms), len(untils))
+	}
+	var ret []validity
+	for i := range froms {
+		v, err := formValidity(froms[i], untils[i])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// nullTime turns a validity time into a database value.
+func nullTime(t int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: t, Valid: t != 0}
+}
+
+func ruleValidityHandler(r *http.Request) (interface{}, error) {
+	id := assertRuleID(mux.Vars(r)["ruleID"])
+	v, err := formValidity(r.FormValue("valid_from"), r.FormValue("valid_until"))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Setting validity of %s to %q-%q", id, v.From(), v.Until())
+	return "OK", txWrap(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE rules SET valid_from=?, valid_until=? WHERE rule_id=?`, nullTime(v.ValidFrom), nullTime(v.ValidUntil), string(id))
+		return err
+	})
+}
+
+// archiveRows moves rows matching where from table into the archive, and
+// returns how many there were.
+func archiveRows(tx *sql.Tx, now time.Time, table, where string, args []interface{}) (int, error) {
+	rows, err := tx.Query(`SELECT * FROM `+table+` WHERE `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return 0, err
+	}
+	var all []map[string]interface{}
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for n := range vals {
+			ptrs[n] = &vals[n]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		m := make(map[string]interface{})
+		for n, c := range cols {
+			if b, ok := vals[n].([]byte); ok {
+				vals[n] = string(b)
+			}
+			m[c] = vals[n]
+		}
+		all = append(all, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, m := range all {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`INSERT INTO archive(archived, kind, data) VALUES(?,?,?)`, now.Unix(), table, string(b)); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM `+table+` WHERE `+where, args...); err != nil {
+		return 0, err
+	}
+	return len(all), nil
+}
+
+// archiveExpired archives rules, grants and memberships that expired before
+// the given time. Archived rules are removed from their ACLs, and which ACLs
+// they were in is archived too.
+func archiveExpired(before time.Time) (int, error) {
+	now := time.Now()
+	expired := `valid_until IS NOT NULL AND valid_until <= ?`
+	args := []interface{}{before.Unix()}
+	total := 0
+	err := txWrap(func(tx *sql.Tx) error {
+		n, err := archiveRows(tx, now, "groupaccess", expired, args)
+		if err != nil {
+			return err
+		}
+		total += n
+		if n, err = archiveRows(tx, now, "members", expired, args); err != nil {
+			return err
+		}
+		total += n
+
+		// Rules are referenced by aclrules and rule_hits.
+		sub := `rule_id IN (SELECT rule_id FROM rules WHERE ` + expired + `)`
+		if _, err := tx.Exec(`DELETE FROM rule_hits WHERE `+sub, args...); err != nil {
+			return err
+		}
+		if _, err := archiveRows(tx, now, "aclrules", sub, args); err != nil {
+			return err
+		}
+		if n, err = archiveRows(tx, now, "rules", expired, args); err != nil {
+			return err
+		}
+		total += n
+		return nil
+	})
+	return total, err
+}
+
+// archiver periodically archives expired entries.
+func archiver() {
+	for {
+		n, err := archiveExpired(time.Now().Add(-*archiveAfter))
+		if err != nil {
+			log.Printf("Failed to archive expired entries: %v", err)
+		} else if n > 0 {
+			log.Printf("Archived %d expired rules, grants and memberships", n)
+		}
+		time.Sleep(archiveInterval)
+	}
+}
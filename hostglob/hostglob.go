@@ -0,0 +1,88 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package hostglob matches hostnames against glob patterns, such as
+// "*.blob.core.windows.net" or "updates-*.vendor.com".
+//
+// Patterns are dot separated labels. In a label, "*" matches any characters
+// except dots, so it stays within one label. A label that is just "*" matches
+// exactly one whole label. "**" matches any characters including dots, so a
+// "**" label matches one or more whole labels. Matching is case insensitive,
+// and ignores a trailing dot on the hostname.
+package hostglob
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern is a compiled hostname glob.
+type Pattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Compile parses a hostname glob.
+func Compile(s string) (*Pattern, error) {
+	s = strings.TrimSuffix(strings.ToLower(s), ".")
+	if s == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '*') {
+			return nil, fmt.Errorf("invalid character %q in host pattern %q", c, s)
+		}
+	}
+	if strings.Contains(s, "***") {
+		return nil, fmt.Errorf("too many '*' in a row in host pattern %q", s)
+	}
+	var res []string
+	for _, label := range strings.Split(s, ".") {
+		switch label {
+		case "":
+			return nil, fmt.Errorf("empty label in host pattern %q", s)
+		case "*":
+			res = append(res, `[^.]+`)
+		case "**":
+			res = append(res, `[^.]+(?:\.[^.]+)*`)
+		default:
+			var l []string
+			for i, part := range strings.Split(label, "**") {
+				if i > 0 {
+					l = append(l, `.*`)
+				}
+				l = append(l, strings.Replace(regexp.QuoteMeta(part), `\*`, `[^.]*`, -1))
+			}
+			res = append(res, strings.Join(l, ""))
+		}
+	}
+	re, err := regexp.Compile(`^` + strings.Join(res, `\.`) + `$`)
+	if err != nil {
+		return nil, fmt.Errorf("compiling host pattern %q: %v", s, err)
+	}
+	return &Pattern{pattern: s, re: re}, nil
+}
+
+// Match returns true if host matches the pattern.
+func (p *Pattern) Match(host string) bool {
+	return p.re.MatchString(strings.TrimSuffix(strings.ToLower(host), "."))
+}
+
+// String returns the pattern in normal form.
+func (p *Pattern) String() string {
+	return p.pattern
+}
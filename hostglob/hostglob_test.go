@@ -0,0 +1,70 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package hostglob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"*.blob.core.windows.net", "foo.blob.core.windows.net", true},
+		{"*.blob.core.windows.net", "FOO.Blob.Core.Windows.Net.", true},
+		{"*.blob.core.windows.net", "blob.core.windows.net", false},
+		{"*.blob.core.windows.net", "a.b.blob.core.windows.net", false},
+		{"**.blob.core.windows.net", "a.b.blob.core.windows.net", true},
+		{"**.blob.core.windows.net", "blob.core.windows.net", false},
+		{"updates-*.vendor.com", "updates-eu.vendor.com", true},
+		{"updates-*.vendor.com", "updates-.vendor.com", true},
+		{"updates-*.vendor.com", "updates-eu.x.vendor.com", false},
+		{"updates-*.vendor.com", "xupdates-eu.vendor.com", false},
+		{"updates-**.vendor.com", "updates-eu.x.vendor.com", true},
+		{"cdn*.example.com", "cdn.example.com", true},
+		{"cdn*.example.com", "cdn12.example.com", true},
+		{"www.example.com", "www.example.com", true},
+		{"www.example.com", "wwwxexample.com", false},
+		{"a.*.c", "a.b.c", true},
+		{"a.*.c", "a..c", false},
+		{"a.**.c", "a.b.b.c", true},
+	} {
+		p, err := Compile(test.pattern)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", test.pattern, err)
+			continue
+		}
+		if got := p.Match(test.host); got != test.want {
+			t.Errorf("%q matching %q: got %t, want %t", test.pattern, test.host, got, test.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		".",
+		".example.com",
+		"a..example.com",
+		"***.example.com",
+		"exa_mple.com",
+		"example.com:443",
+		"[a-z].example.com",
+	} {
+		if _, err := Compile(s); err == nil {
+			t.Errorf("Compile(%q): expected error", s)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics keeps counters, gauges and histograms, and exports them in
+// the Prometheus text format, over HTTP or to a file for the node exporter's
+// textfile collector.
+//
+// Metrics can have labels. Values for them are given, in the order the label
+// names were, when updating the metric.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/squidwarden/atomicfile"
+)
+
+// LatencyBuckets are histogram buckets for latencies in seconds, from 100µs
+// to 10s.
+var LatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics to export together.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	fixed    []string // Formatted name="value" pairs added to every series.
+}
+
+// Default is the registry the package level functions use.
+var Default = &Registry{}
+
+// family is a metric and all its series, one per set of label values.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64 // Histograms only.
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+
+	// Histograms only. Counts are per bucket, not cumulative, with the last
+	// one for +Inf.
+	counts []uint64
+	count  uint64
+}
+
+func (r *Registry) add(name, help, typ string, buckets []float64, labels []string) *family {
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range r.families {
+		if o.name == name {
+			panic(fmt.Sprintf("metric %q registered twice", name))
+		}
+	}
+	r.families = append(r.families, f)
+	if len(labels) == 0 {
+		// Export it as zero until updated.
+		f.update(nil, func(*series) {})
+	}
+	return f
+}
+
+// AddLabel adds a label with a fixed value to every metric, such as to tell
+// apart processes whose metrics end up in the same place.
+func (r *Registry) AddLabel(name, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fixed = append(r.fixed, fmt.Sprintf(`%s="%s"`, name, escape(value, true)))
+}
+
+// update calls fn with the series for the label values, creating it if need
+// be, with the family locked.
+func (f *family) update(values []string, fn func(*series)) {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %q has labels %q, got values %q", f.name, f.labels, values))
+	}
+	k := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.series[k]
+	if s == nil {
+		s = &series{labels: append([]string(nil), values...)}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[k] = s
+	}
+	fn(s)
+}
+
+// Counter is a value that only goes up, such as a number of requests.
+type Counter struct{ f *family }
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.add(name, help, "counter", nil, labels)}
+}
+
+// Add adds v, which must not be negative.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %q decreased by %v", c.f.name, v))
+	}
+	c.f.update(values, func(s *series) { s.value += v })
+}
+
+// Inc adds one.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that goes up and down, such as a number of connections.
+type Gauge struct{ f *family }
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.add(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the value.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.f.update(values, func(s *series) { s.value = v })
+}
+
+// Add adds v, which may be negative.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.f.update(values, func(s *series) { s.value += v })
+}
+
+// Histogram counts observations, such as latencies, in buckets.
+type Histogram struct{ f *family }
+
+// NewHistogram registers a histogram. Buckets are the upper bounds, in
+// increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("histogram %q buckets not sorted: %v", name, buckets))
+	}
+	return &Histogram{r.add(name, help, "histogram", buckets, labels)}
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.f.update(values, func(s *series) {
+		s.counts[sort.SearchFloat64s(h.f.buckets, v)]++
+		s.count++
+		s.value += v
+	})
+}
+
+// NewCounter registers a counter in the default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewGauge registers a gauge in the default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewHistogram registers a histogram in the default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// Write writes all metrics in the Prometheus text format, sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	fs := append([]*family(nil), r.families...)
+	fixed := r.fixed
+	r.mu.Unlock()
+	sort.Slice(fs, func(i, j int) bool { return fs[i].name < fs[j].name })
+
+	var b bytes.Buffer
+	for _, f := range fs {
+		f.write(&b, fixed)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (f *family) write(b *bytes.Buffer, fixed []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+	var keys []string
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.typ != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelString(fixed, s.labels, ""), formatFloat(s.value))
+			continue
+		}
+		var n uint64
+		for i, c := range s.counts {
+			n += c
+			le := math.Inf(1)
+			if i < len(f.buckets) {
+				le = f.buckets[i]
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelString(fixed, s.labels, formatFloat(le)), n)
+		}
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelString(fixed, s.labels, ""), formatFloat(s.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelString(fixed, s.labels, ""), s.count)
+	}
+}
+
+// labelString formats label pairs, after the fixed ones and with le added if
+// not empty.
+func (f *family) labelString(fixed, values []string, le string) string {
+	l := append([]string(nil), fixed...)
+	for i, n := range f.labels {
+		l = append(l, fmt.Sprintf(`%s="%s"`, n, escape(values[i], true)))
+	}
+	if le != "" {
+		l = append(l, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP serves the metrics, for Prometheus to scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	// Errors are the scraper going away, and it's too late for a status.
+	r.Write(w)
+}
+
+// WriteFile writes the metrics to a file, replacing it atomically so that a
+// textfile collector never reads half of it.
+func (r *Registry) WriteFile(fn string) error {
+	return atomicfile.Write(fn, r.Write)
+}
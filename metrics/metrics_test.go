@@ -0,0 +1,115 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := &Registry{}
+	c := r.NewCounter("requests_total", "Requests.", "route", "code")
+	g := r.NewGauge("connections", "Open connections.")
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{.1, 1})
+
+	c.Inc("/a", "200")
+	c.Add(2, "/a", "200")
+	c.Inc(`/"b"`, "500")
+	g.Add(2)
+	g.Add(-1)
+	h.Observe(.05)
+	h.Observe(.1)
+	h.Observe(5)
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP connections Open connections.
+# TYPE connections gauge
+connections 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.15
+latency_seconds_count 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="/\"b\"",code="500"} 1
+requests_total{route="/a",code="200"} 3
+`
+	if got := b.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAddLabel(t *testing.T) {
+	r := &Registry{}
+	r.AddLabel("pid", "42")
+	r.NewCounter("requests_total", "Requests.", "code").Inc("200")
+	r.NewHistogram("latency_seconds", "Latency.", []float64{1}).Observe(.5)
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{pid="42",le="1"} 1
+latency_seconds_bucket{pid="42",le="+Inf"} 1
+latency_seconds_sum{pid="42"} 0.5
+latency_seconds_count{pid="42"} 1
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{pid="42",code="200"} 1
+`
+	if got := b.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squidwarden_metrics_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Registry{}
+	r.NewCounter("lines_total", "Lines.").Inc()
+	fn := filepath.Join(dir, "helper.prom")
+	if err := r.WriteFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "# HELP lines_total Lines.\n# TYPE lines_total counter\nlines_total 1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if fs, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(fs) != 1 {
+		t.Errorf("want only the metrics file left, got %d files", len(fs))
+	}
+}
@@ -0,0 +1,29 @@
+-- Adds the policy generation counter to databases created before it existed.
+-- sqlite3 proxyacl.sqlite < migrations/0001-generation.sql
+BEGIN TRANSACTION;
+CREATE TABLE generation(
+       generation INTEGER NOT NULL
+);
+INSERT INTO generation(generation) VALUES(0);
+CREATE TRIGGER sources_insert AFTER INSERT ON sources BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER sources_update AFTER UPDATE ON sources BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER sources_delete AFTER DELETE ON sources BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER groups_insert AFTER INSERT ON groups BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER groups_update AFTER UPDATE ON groups BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER groups_delete AFTER DELETE ON groups BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER members_insert AFTER INSERT ON members BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER members_update AFTER UPDATE ON members BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER members_delete AFTER DELETE ON members BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER acls_insert AFTER INSERT ON acls BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER acls_update AFTER UPDATE ON acls BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER acls_delete AFTER DELETE ON acls BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER aclrules_insert AFTER INSERT ON aclrules BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER aclrules_update AFTER UPDATE ON aclrules BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER aclrules_delete AFTER DELETE ON aclrules BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER rules_insert AFTER INSERT ON rules BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER rules_update AFTER UPDATE ON rules BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER rules_delete AFTER DELETE ON rules BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER groupaccess_insert AFTER INSERT ON groupaccess BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER groupaccess_update AFTER UPDATE ON groupaccess BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER groupaccess_delete AFTER DELETE ON groupaccess BEGIN UPDATE generation SET generation=generation+1; END;
+COMMIT;
@@ -0,0 +1,2 @@
+-- Adds schedules to group access.
+ALTER TABLE groupaccess ADD COLUMN schedule TEXT;
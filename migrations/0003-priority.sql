@@ -0,0 +1,2 @@
+-- Adds ACL priorities.
+ALTER TABLE acls ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- Adds HTTP method restrictions to rules.
+ALTER TABLE rules ADD COLUMN methods TEXT;
@@ -0,0 +1,7 @@
+-- Adds rule hit counts.
+CREATE TABLE rule_hits(
+       rule_id TEXT NOT NULL,
+       hits INTEGER NOT NULL DEFAULT 0,
+       last_hit INTEGER,
+       PRIMARY KEY(rule_id)
+);
@@ -0,0 +1,17 @@
+-- Adds access requests.
+CREATE TABLE access_requests(
+       request_id TEXT NOT NULL,
+       created INTEGER NOT NULL,
+       url TEXT NOT NULL,
+       client TEXT,
+       user TEXT,
+       note TEXT,
+       -- "pending", "approved" or "rejected".
+       status TEXT NOT NULL,
+       -- Rejection reason, shown to the requester.
+       reason TEXT,
+       -- Rule created on approval.
+       rule_id TEXT,
+       decided INTEGER,
+       PRIMARY KEY(request_id)
+);
@@ -0,0 +1,15 @@
+-- Adds validity periods to rules, grants and memberships.
+ALTER TABLE rules ADD COLUMN valid_from INTEGER;
+ALTER TABLE rules ADD COLUMN valid_until INTEGER;
+ALTER TABLE groupaccess ADD COLUMN valid_from INTEGER;
+ALTER TABLE groupaccess ADD COLUMN valid_until INTEGER;
+ALTER TABLE members ADD COLUMN valid_from INTEGER;
+ALTER TABLE members ADD COLUMN valid_until INTEGER;
+
+-- Rules, grants and memberships removed after they stopped being in effect.
+-- "kind" is the table they were in, and "data" the row as JSON.
+CREATE TABLE archive(
+       archived INTEGER NOT NULL,
+       kind TEXT NOT NULL,
+       data TEXT NOT NULL
+);
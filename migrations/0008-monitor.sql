@@ -0,0 +1,13 @@
+-- Adds observe-only groups, and the log of what they would have had blocked.
+ALTER TABLE groups ADD COLUMN monitor INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE monitor_log(
+       group_id TEXT NOT NULL,
+       site TEXT NOT NULL,
+       example TEXT NOT NULL,
+       reason TEXT NOT NULL,
+       hits INTEGER NOT NULL DEFAULT 0,
+       first_hit INTEGER NOT NULL,
+       last_hit INTEGER NOT NULL,
+       PRIMARY KEY(group_id, site)
+);
@@ -0,0 +1,2 @@
+-- Adds a per group action for requests no rule matches.
+ALTER TABLE groups ADD COLUMN default_action TEXT;
@@ -0,0 +1,9 @@
+-- Adds policy settings, starting with the global default action.
+CREATE TABLE settings(
+       name TEXT NOT NULL,
+       value TEXT NOT NULL,
+       PRIMARY KEY(name)
+);
+CREATE TRIGGER settings_insert AFTER INSERT ON settings BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER settings_update AFTER UPDATE ON settings BEGIN UPDATE generation SET generation=generation+1; END;
+CREATE TRIGGER settings_delete AFTER DELETE ON settings BEGIN UPDATE generation SET generation=generation+1; END;
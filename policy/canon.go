@@ -0,0 +1,118 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+// Canonicalization of hosts and URLs, applied to both rule values and
+// requests, so that different spellings of the same URL match the same rules.
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// canonicalHost strips any trailing dot from host, and maps and converts
+// internationalized labels to ASCII as for DNS lookups (UTS #46), which also
+// lowercases. Labels that aren't valid host names, like "*" or CIDR masks,
+// are just lowercased.
+func canonicalHost(host string) string {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	for i, l := range labels {
+		if a, err := idna.Lookup.ToASCII(l); err == nil {
+			labels[i] = a
+		} else {
+			labels[i] = strings.ToLower(l)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// canonicalHostPort canonicalizes the host of a host:port, host or
+// [v6addr]:port, leaving the port as is.
+func canonicalHostPort(s string) string {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return canonicalHost(s)
+	}
+	return net.JoinHostPort(canonicalHost(host), port)
+}
+
+// defaultPorts are the ports dropped from canonical URLs.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+}
+
+// canonicalURL returns the canonical form of an absolute URL: lowercase scheme
+// and host, host in punycode without trailing dot, no default port, normalized
+// path and percent-encoding, and no fragment.
+func canonicalURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return s, nil
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := canonicalHost(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		host += ":" + port
+	}
+	ret := scheme + "://"
+	if u.User != nil {
+		ret += u.User.String() + "@"
+	}
+	ret += host + normalizePath(u.EscapedPath())
+	if u.RawQuery != "" || u.ForceQuery {
+		ret += "?" + normalizePercent(u.RawQuery)
+	}
+	return ret, nil
+}
+
+// canonicalURI returns the canonical form of a request URI from squid. Plain
+// HTTP requests have URLs, and CONNECT requests have host:port. URIs that
+// can't be parsed are returned as is, for the rules to report.
+func canonicalURI(proto, method, uri string) string {
+	switch {
+	case proto == "HTTP":
+		if c, err := canonicalURL(uri); err == nil {
+			return c
+		}
+	case method == "CONNECT":
+		if _, _, err := net.SplitHostPort(uri); err == nil {
+			return canonicalHostPort(uri)
+		}
+	}
+	return uri
+}
+
+// canonicalRuleHost canonicalizes a domain rule value: a host, CIDR or
+// ".domain", optionally with a port.
+func canonicalRuleHost(value string) string {
+	suffix := strings.HasPrefix(value, ".")
+	value = canonicalHostPort(strings.TrimPrefix(value, "."))
+	if suffix {
+		value = "." + value
+	}
+	return value
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Trace is how a request was evaluated, step by step.
+type Trace struct {
+	// The request as matched, with the URI canonicalized.
+	Request Request
+
+	// Sources that apply to the request, in the order they're checked.
+	Sources []SourceTrace
+}
+
+// SourceTrace is a source that applies to a request, and the ACLs it's been
+// granted through its groups, highest priority first.
+type SourceTrace struct {
+	SourceID string
+	Source   string
+
+	// False if an earlier source decided, so this one wasn't looked at.
+	Checked bool
+
+	Grants []GrantTrace
+}
+
+// GrantTrace is an ACL granted to a source through a group.
+type GrantTrace struct {
+	GroupID    string
+	ACLID      string
+	ACLComment string
+	Priority   int
+	Schedule   string
+
+	// False if the schedule isn't active, so the rules weren't checked.
+	Active bool
+
+	// Rules in the order they take precedence: block first, then ignore,
+	// then allow, each by rule ID.
+	Rules []RuleTrace
+}
+
+// RuleTrace is a rule checked against the request.
+type RuleTrace struct {
+	RuleID  string
+	Type    string
+	Value   string
+	Action  Action
+	Methods string
+
+	Matched bool
+	Decided bool
+
+	// Set if the rule failed to evaluate.
+	Error string
+}
+
+// Explain evaluates a request like Evaluate, and also returns a trace of
+// every source, grant and rule that was looked at.
+//
+// The decision is always the one Evaluate makes. The trace checks every rule
+// of every active grant of the sources up to the deciding one, so it shows
+// rules that matched but lost to a higher precedence one too.
+func Explain(cfg *Config, req *Request) (Decision, *Trace, error) {
+	d, err := Evaluate(cfg, req)
+	if err != nil {
+		return d, nil, err
+	}
+	creq := Canonicalize(req)
+	t := &Trace{Request: *creq}
+	if strings.HasPrefix(req.URI, "cache_object://") {
+		return d, t, nil
+	}
+
+	checked := true
+	for _, s := range cfg.lookupSources(creq.User, net.ParseIP(creq.Src)) {
+		st := SourceTrace{
+			SourceID: s.id,
+			Source:   s.source.String(),
+			Checked:  checked,
+		}
+		deciding := checked && d.Found && s.id == d.SourceID
+		for _, g := range s.grants {
+			gt := GrantTrace{
+				GroupID:    g.group,
+				ACLID:      g.acl,
+				ACLComment: g.rules.comment,
+				Priority:   g.rules.priority,
+				Schedule:   g.schedule.String(),
+				Active:     g.schedule.Active(creq.Time),
+			}
+			if checked && gt.Active {
+				for _, id := range g.rules.ruleIDs() {
+					rt := explainRule(cfg, id, creq)
+					rt.Decided = deciding && rt.Matched && g.group == d.GroupID && g.acl == d.ACLID && id == d.RuleID
+					gt.Rules = append(gt.Rules, rt)
+				}
+			}
+			st.Grants = append(st.Grants, gt)
+		}
+		if deciding {
+			checked = false
+		}
+		t.Sources = append(t.Sources, st)
+	}
+	return d, t, nil
+}
+
+// ruleIDs returns the rules of an ACL in the order they take precedence.
+func (x *aclIndex) ruleIDs() []string {
+	var ret []string
+	for _, ms := range x.ranks {
+		var ids []string
+		for _, m := range ms {
+			ids = append(ids, m.rules.rules...)
+		}
+		sort.Strings(ids)
+		ret = append(ret, ids...)
+	}
+	return ret
+}
+
+func explainRule(cfg *Config, id string, req *Request) RuleTrace {
+	r := cfg.Rules[id]
+	rt := RuleTrace{
+		RuleID:  id,
+		Type:    r.typ,
+		Value:   r.value,
+		Action:  r.action,
+		Methods: methodsString(r.methods),
+	}
+	if !r.methods.contains(req.Method) {
+		return rt
+	}
+	m, err := checkRule(r.rule, req, req.tlsNamesApply(actionRank(r.action)))
+	if err != nil {
+		rt.Error = err.Error()
+	}
+	rt.Matched = m && err == nil
+	return rt
+}
+
+// Write writes the trace and decision as text.
+func (t *Trace) Write(w io.Writer, d Decision) error {
+	var b bytes.Buffer
+	r := &t.Request
+	fmt.Fprintf(&b, "Request: %s %s %s %s", r.Proto, r.Src, r.Method, r.URI)
+	if r.User != "" {
+		fmt.Fprintf(&b, " user %s", r.User)
+	}
+	if r.SNI != "" {
+		fmt.Fprintf(&b, " SNI %s", r.SNI)
+	}
+	if len(r.CertNames) > 0 {
+		fmt.Fprintf(&b, " certificate for %s", strings.Join(r.CertNames, ","))
+	}
+	fmt.Fprintf(&b, " at %s\n", r.Time.Format("2006-01-02 15:04:05 MST"))
+	if len(t.Sources) == 0 {
+		fmt.Fprintf(&b, "No source contains the address.\n")
+	}
+	for _, s := range t.Sources {
+		fmt.Fprintf(&b, "Source %s (%s)", s.SourceID, s.Source)
+		if !s.Checked {
+			fmt.Fprintf(&b, ", not checked")
+		}
+		fmt.Fprintf(&b, "\n")
+		for _, g := range s.Grants {
+			fmt.Fprintf(&b, "  Group %s, ACL %s", g.GroupID, g.ACLID)
+			if g.ACLComment != "" {
+				fmt.Fprintf(&b, " %q", g.ACLComment)
+			}
+			fmt.Fprintf(&b, ", priority %d", g.Priority)
+			if g.Schedule != "" {
+				fmt.Fprintf(&b, ", schedule %q", g.Schedule)
+				if !g.Active {
+					fmt.Fprintf(&b, " (inactive)")
+				}
+			}
+			fmt.Fprintf(&b, "\n")
+			for _, rt := range g.Rules {
+				mark := "no match"
+				switch {
+				case rt.Decided:
+					mark = "DECIDED"
+				case rt.Matched:
+					mark = "match"
+				case rt.Error != "":
+					mark = "error: " + rt.Error
+				}
+				fmt.Fprintf(&b, "    %-8s %s %s %q", mark, rt.RuleID, rt.Type, rt.Value)
+				if rt.Methods != "" {
+					fmt.Fprintf(&b, " methods %s", rt.Methods)
+				}
+				fmt.Fprintf(&b, " -> %s\n", rt.Action)
+			}
+		}
+	}
+	if d.Found {
+		fmt.Fprintf(&b, "Decision: %s by rule %s in ACL %s, group %s, source %s\n", d.Action, d.RuleID, d.ACLID, d.GroupID, d.SourceID)
+	} else if d.DefaultGroup != "" {
+		fmt.Fprintf(&b, "Decision: %s, no rule matched, default of group %s\n", d.Action, d.DefaultGroup)
+	} else {
+		fmt.Fprintf(&b, "Decision: %s, no rule matched\n", d.Action)
+	}
+	if d.Monitor {
+		fmt.Fprintf(&b, "Group %s is monitored, so blocks are logged but not enforced\n", d.GroupID)
+	}
+	if !d.Expires.IsZero() {
+		fmt.Fprintf(&b, "Valid until %s\n", d.Expires.Format("2006-01-02 15:04:05 MST"))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
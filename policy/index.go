@@ -0,0 +1,419 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+// Indexes used to evaluate large rule sets without checking every rule.
+//
+// Every index answers the same question as walking the rule list in order and
+// calling Check on every rule: "what is the first rule in the list that
+// matches?". They just do it without looking at the rules that can't match.
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// portEntry is a rule at position pos in the rule list, that only applies to
+// port, or any port if port is "*".
+type portEntry struct {
+	port string
+	pos  int
+}
+
+func (e portEntry) matches(port string) bool {
+	return e.port == "*" || e.port == port
+}
+
+// firstMatch returns the lowest position in es that matches port, if lower
+// than best. Otherwise returns best.
+func firstMatch(es []portEntry, port string, best int) int {
+	for _, e := range es {
+		if e.pos < best && e.matches(port) {
+			best = e.pos
+		}
+	}
+	return best
+}
+
+// hostTrie is a trie of hostnames keyed on reversed labels, so that all
+// suffix rules that apply to a host are found on the path from the root to the
+// host.
+type hostTrie struct {
+	children map[string]*hostTrie
+
+	// Rules matching only exactly this host.
+	exact []portEntry
+
+	// Rules matching this host and everything under it.
+	suffix []portEntry
+}
+
+// reverseLabels returns the labels of host, TLD first.
+func reverseLabels(host string) []string {
+	l := strings.Split(host, ".")
+	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+		l[i], l[j] = l[j], l[i]
+	}
+	return l
+}
+
+// add adds a domain rule value (without port). A leading dot means it
+// matches the domain and all subdomains.
+func (t *hostTrie) add(host string, e portEntry) {
+	suffix := strings.HasPrefix(host, ".")
+	if suffix {
+		host = host[1:]
+	}
+	n := t
+	for _, label := range reverseLabels(host) {
+		if n.children == nil {
+			n.children = make(map[string]*hostTrie)
+		}
+		c, found := n.children[label]
+		if !found {
+			c = &hostTrie{}
+			n.children[label] = c
+		}
+		n = c
+	}
+	if suffix {
+		n.suffix = append(n.suffix, e)
+	} else {
+		n.exact = append(n.exact, e)
+	}
+}
+
+// lookup returns the first rule that matches host and port, if lower than
+// best.
+func (t *hostTrie) lookup(host, port string, best int) int {
+	n := t
+	for _, label := range reverseLabels(host) {
+		n = n.children[label]
+		if n == nil {
+			return best
+		}
+		best = firstMatch(n.suffix, port, best)
+	}
+	return firstMatch(n.exact, port, best)
+}
+
+// netTrie is a binary radix tree of networks, so that all networks containing
+// an address are found on the path from the root to the address.
+type netTrie struct {
+	v4, v6 *netNode
+}
+
+type netNode struct {
+	child   [2]*netNode
+	entries []portEntry
+}
+
+// netKey returns the address bytes that net.IPNet.Contains compares, so that
+// the tree gives the same results as Contains.
+func netKey(ip net.IP) (net.IP, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, true
+	}
+	return ip, false
+}
+
+func (t *netTrie) add(n *net.IPNet, e portEntry) {
+	ones, _ := n.Mask.Size()
+	ip := n.IP
+	root := &t.v6
+	if len(n.Mask) == net.IPv4len {
+		ip = ip.To4()
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &netNode{}
+	}
+	node := *root
+	for i := 0; i < ones; i++ {
+		b := (ip[i/8] >> uint(7-i%8)) & 1
+		if node.child[b] == nil {
+			node.child[b] = &netNode{}
+		}
+		node = node.child[b]
+	}
+	node.entries = append(node.entries, e)
+}
+
+// visit calls f for all entries of networks containing ip, least specific
+// network first.
+func (t *netTrie) visit(ip net.IP, f func(portEntry)) {
+	key, v4 := netKey(ip)
+	node := t.v6
+	if v4 {
+		node = t.v4
+	}
+	for i := 0; node != nil; i++ {
+		for _, e := range node.entries {
+			f(e)
+		}
+		if i == len(key)*8 {
+			break
+		}
+		node = node.child[(key[i/8]>>uint(7-i%8))&1]
+	}
+}
+
+// lookup returns the first rule for a network containing host, and that
+// matches port, if lower than best.
+func (t *netTrie) lookup(host, port string, best int) int {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return best
+	}
+	t.visit(ip, func(e portEntry) {
+		if e.pos < best && e.matches(port) {
+			best = e.pos
+		}
+	})
+	return best
+}
+
+// regexSet is a set of regexes combined into one, where submatches tell which
+// one matched first.
+type regexSet struct {
+	re *regexp.Regexp
+
+	// Position in rule list of each regex, and its marker submatch.
+	pos    []int
+	marker []int
+
+	// Individual regexes, used if the combined one failed to compile.
+	fallback []*regexp.Regexp
+}
+
+// newRegexSet creates a regex set out of anchored rule regexes.
+func newRegexSet(res []*regexp.Regexp, pos []int) *regexSet {
+	if len(res) == 0 {
+		return nil
+	}
+	s := &regexSet{pos: pos}
+	var alts []string
+	group := 0
+	for _, re := range res {
+		// Each alternative is a complete unanchored search for the rule
+		// regex, followed by an empty marker group. Since the combined regex
+		// is anchored at the start, leftmost-first semantics means the first
+		// alternative that can match is the one that does.
+		alts = append(alts, `(?s:.*?)(?:`+re.String()+`)()`)
+		group += re.NumSubexp() + 1
+		s.marker = append(s.marker, group)
+	}
+	re, err := regexp.Compile(`^(?:` + strings.Join(alts, "|") + `)`)
+	if err != nil {
+		log.Printf("Failed to combine %d regexes, will check them one by one: %v", len(res), err)
+		s.fallback = res
+		return s
+	}
+	s.re = re
+	return s
+}
+
+// lookup returns the position of the first regex matching s, if lower than
+// best.
+func (s *regexSet) lookup(str string, best int) int {
+	if s == nil {
+		return best
+	}
+	if s.re == nil {
+		for n, re := range s.fallback {
+			if s.pos[n] < best && re.MatchString(str) {
+				return s.pos[n]
+			}
+		}
+		return best
+	}
+	m := s.re.FindStringSubmatchIndex(str)
+	if m == nil {
+		return best
+	}
+	for n, g := range s.marker {
+		if m[2*g] >= 0 {
+			if s.pos[n] < best {
+				return s.pos[n]
+			}
+			return best
+		}
+	}
+	return best
+}
+
+// ruleIndex finds the first rule in a rule list that matches a request.
+type ruleIndex struct {
+	// Rule IDs in evaluation order.
+	rules []string
+
+	// domain
+	httpHosts hostTrie
+	httpNets  netTrie
+
+	// https-domain
+	httpsHosts hostTrie
+	httpsNets  netTrie
+
+	// exact. Map from URL to first position.
+	exact map[string]int
+
+	// regex and https-regex.
+	regex      *regexSet
+	httpsRegex *regexSet
+
+	// Positions of rules that can't be indexed, and are checked one by one.
+	other []int
+}
+
+func newRuleIndex(rules []string, all map[string]RuleAction) *ruleIndex {
+	x := &ruleIndex{
+		rules: rules,
+		exact: make(map[string]int),
+	}
+	var regexes, httpsRegexes []*regexp.Regexp
+	var regexPos, httpsRegexPos []int
+	for pos, id := range rules {
+		switch r := all[id].rule.(type) {
+		case *DomainRule:
+			if r.value == "" {
+				continue
+			}
+			host, port := splitHostPortDefault(r.value, "80")
+			x.httpHosts.add(host, portEntry{port: port, pos: pos})
+			if _, cidr, err := net.ParseCIDR(host); err == nil {
+				x.httpNets.add(cidr, portEntry{port: port, pos: pos})
+			}
+		case *HTTPSDomainRule:
+			host, port := splitHostPortDefault(r.value, "443")
+			if host == "" {
+				continue
+			}
+			x.httpsHosts.add(host, portEntry{port: port, pos: pos})
+			if _, cidr, err := net.ParseCIDR(host); err == nil {
+				x.httpsNets.add(cidr, portEntry{port: port, pos: pos})
+			}
+		case *ExactRule:
+			if _, found := x.exact[r.value]; !found {
+				x.exact[r.value] = pos
+			}
+		case *RegexRule:
+			regexes = append(regexes, r.re)
+			regexPos = append(regexPos, pos)
+		case *HTTPSRegexRule:
+			httpsRegexes = append(httpsRegexes, r.re)
+			httpsRegexPos = append(httpsRegexPos, pos)
+		default:
+			x.other = append(x.other, pos)
+		}
+	}
+	x.regex = newRegexSet(regexes, regexPos)
+	x.httpsRegex = newRegexSet(httpsRegexes, httpsRegexPos)
+	return x
+}
+
+// match returns the ID of the first rule that matches the canonical request.
+// tls says whether the rules may match on the TLS names.
+func (x *ruleIndex) match(all map[string]RuleAction, req *Request, tls bool) (string, bool) {
+	best := len(x.rules)
+	switch req.Proto {
+	case "HTTP":
+		if pos, found := x.exact[req.URI]; found {
+			best = pos
+		}
+		best = x.regex.lookup(req.URI, best)
+		if p, err := url.Parse(req.URI); err != nil {
+			log.Printf("Failed to parse URL %q: %v", req.URI, err)
+		} else {
+			host, port := splitHostPortDefault(p.Host, "80")
+			best = x.httpHosts.lookup(host, port, best)
+			best = x.httpNets.lookup(host, port, best)
+		}
+	case "NONE":
+		uris := []string{req.URI}
+		if uri := req.sniURI(); uri != "" && tls {
+			uris = append(uris, uri)
+		}
+		for _, uri := range uris {
+			best = x.httpsRegex.lookup(uri, best)
+			if req.Method != "CONNECT" {
+				continue
+			}
+			if host, port, err := net.SplitHostPort(uri); err != nil {
+				log.Printf("Failed to parse HTTPS host:port %q: %v", uri, err)
+			} else {
+				best = x.httpsHosts.lookup(host, port, best)
+				best = x.httpsNets.lookup(host, port, best)
+			}
+		}
+	}
+	for _, pos := range x.other {
+		if pos >= best {
+			break
+		}
+		id := x.rules[pos]
+		t, err := checkRule(all[id].rule, req, tls)
+		if err != nil {
+			log.Printf("Failed to evaluate rule %q: %v", id, err)
+		} else if t {
+			best = pos
+			break
+		}
+	}
+	if best == len(x.rules) {
+		return "", false
+	}
+	return x.rules[best], true
+}
+
+// sourceIndex finds the sources that contain an address.
+type sourceIndex struct {
+	nets netTrie
+
+	// Sources that aren't networks, and are checked one by one.
+	other []int
+}
+
+func newSourceIndex(sources []sourceRule) *sourceIndex {
+	x := &sourceIndex{}
+	for n, s := range sources {
+		if sn, ok := s.source.(*sourceNet); ok {
+			x.nets.add((*net.IPNet)(sn), portEntry{pos: n})
+		} else {
+			x.other = append(x.other, n)
+		}
+	}
+	return x
+}
+
+// lookup returns the positions of all sources containing a, in order.
+func (x *sourceIndex) lookup(sources []sourceRule, a net.IP) []int {
+	var ret []int
+	x.nets.visit(a, func(e portEntry) {
+		ret = append(ret, e.pos)
+	})
+	for _, n := range x.other {
+		if sources[n].source.Contains(a) {
+			ret = append(ret, n)
+		}
+	}
+	sort.Ints(ret)
+	return ret
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+// URL path normalization, so that path rules can't be bypassed by encoding
+// the same path differently.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isUnreserved returns true for characters that RFC 3986 section 2.3 says
+// mean the same thing percent-encoded or not.
+func isUnreserved(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// normalizePercent decodes percent-encoded unreserved characters and
+// uppercases the hex digits of the rest. A '%' not followed by two hex digits
+// is itself encoded.
+func normalizePercent(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			b = append(b, c)
+			continue
+		}
+		if i+2 < len(s) {
+			hi, ok1 := unhex(s[i+1])
+			lo, ok2 := unhex(s[i+2])
+			if ok1 && ok2 {
+				d := hi<<4 | lo
+				if isUnreserved(d) {
+					b = append(b, d)
+				} else {
+					b = append(b, fmt.Sprintf("%%%02X", d)...)
+				}
+				i += 2
+				continue
+			}
+		}
+		b = append(b, "%25"...)
+	}
+	return string(b)
+}
+
+// removeDotSegments implements RFC 3986 section 5.2.4.
+func removeDotSegments(p string) string {
+	var out []string
+	for len(p) > 0 {
+		switch {
+		case strings.HasPrefix(p, "../"):
+			p = p[3:]
+		case strings.HasPrefix(p, "./"):
+			p = p[2:]
+		case strings.HasPrefix(p, "/./"):
+			p = p[2:]
+		case p == "/.":
+			p = "/"
+		case strings.HasPrefix(p, "/../"):
+			p = p[3:]
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case p == "/..":
+			p = "/"
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case p == "." || p == "..":
+			p = ""
+		default:
+			// Move the first segment, including any leading '/', to the
+			// output.
+			n := strings.IndexByte(p[1:], '/')
+			if n < 0 {
+				n = len(p)
+			} else {
+				n++
+			}
+			out = append(out, p[:n])
+			p = p[n:]
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// normalizePath returns the normal form of an escaped URL path. Two paths
+// that mean the same thing have the same normal form.
+func normalizePath(p string) string {
+	p = removeDotSegments(normalizePercent(p))
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// hasPathPrefix returns true if the normalized path p is prefix or below it.
+// Unless prefix ends in '/' it only matches whole segments, so "/foo" matches
+// "/foo/bar" but not "/foobar".
+func hasPathPrefix(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
@@ -0,0 +1,1316 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package policy decides what squid should do with requests, according to the
+// policy in the squidwarden database.
+package policy
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/squidwarden/hostglob"
+	"github.com/google/squidwarden/schedule"
+)
+
+// Action is what to do with a request.
+type Action string
+
+const (
+	ActionNone   Action = "none"
+	ActionBlock  Action = "block"
+	ActionIgnore Action = "ignore"
+	ActionAllow  Action = "allow"
+
+	// ActionDefault is what to do if no rule matches, no group of the
+	// sources checked has a default action, and the policy has no
+	// default_action setting.
+	ActionDefault = ActionBlock
+)
+
+type source interface {
+	String() string
+	Contains(net.IP) bool
+	PrefixLen() int
+}
+
+type sourceMask struct {
+	host net.IP
+	mask net.IP
+}
+
+func (s *sourceMask) String() string {
+	return s.host.String() + "/" + s.mask.String()
+}
+
+func (s *sourceMask) Contains(a net.IP) bool {
+	for n := range s.host {
+		if s.host[n] != a[n]&s.mask[n] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *sourceMask) PrefixLen() int {
+	// This is used for sorting only.
+	// TODO: what should be sorted by?
+	return 0
+}
+
+type sourceNet net.IPNet
+
+func (s *sourceNet) Contains(a net.IP) bool {
+	return (*net.IPNet)(s).Contains(a)
+}
+
+func (s *sourceNet) String() string {
+	return (*net.IPNet)(s).String()
+}
+
+func (s *sourceNet) PrefixLen() int {
+	r, _ := s.Mask.Size()
+	return r
+}
+
+// sourceUser is a user name authenticated by squid, as "user:name" in the
+// database. User names are case insensitive.
+type sourceUser string
+
+func (s sourceUser) String() string {
+	return "user:" + string(s)
+}
+
+func (s sourceUser) Contains(net.IP) bool {
+	return false
+}
+
+func (s sourceUser) PrefixLen() int {
+	return 0
+}
+
+const userPrefix = "user:"
+
+type sourceRule struct {
+	id     string
+	source source
+
+	// ACLs granted to the source.
+	grants []grant
+
+	// Monitored groups the source is in, if any.
+	monitor []string
+
+	// What to do if no rule matches, from the source's groups, and the
+	// group it's from. Empty if none of them has a default action.
+	deflt        Action
+	defaultGroup string
+}
+
+// addDefault merges the default action of one of the source's groups into
+// the source's. Block beats allow, and ties are broken by group ID.
+func (s *sourceRule) addDefault(a Action, group string) {
+	if s.deflt == "" || actionRank(a) < actionRank(s.deflt) || (a == s.deflt && group < s.defaultGroup) {
+		s.deflt, s.defaultGroup = a, group
+	}
+}
+
+// grant is an ACL granted to a source through a group.
+type grant struct {
+	group    string
+	acl      string
+	schedule *schedule.Schedule
+	rules    *aclIndex
+
+	// The group is monitored, so its blocks aren't enforced.
+	monitor bool
+}
+
+// actionRank returns the precedence of an action among rules that match in
+// ACLs of the same priority. Lower rank wins, so deny overrides everything
+// else.
+func actionRank(a Action) int {
+	switch a {
+	case ActionBlock, ActionNone:
+		return 0
+	case ActionIgnore:
+		return 1
+	case ActionAllow:
+		return 2
+	}
+	return 3
+}
+
+const numRanks = 4
+
+// aclIndex is the rules of an ACL, indexed per action rank and method set.
+type aclIndex struct {
+	priority int
+	comment  string
+	ranks    [numRanks][]methodIndex
+}
+
+// methodIndex is rules that only apply to some methods, or all methods if
+// methods is nil.
+type methodIndex struct {
+	methods methodSet
+	rules   *ruleIndex
+}
+
+func newACLIndex(priority int, rules []string, all map[string]RuleAction) *aclIndex {
+	var ranked [numRanks]map[string][]string
+	for _, id := range rules {
+		r := actionRank(all[id].action)
+		if ranked[r] == nil {
+			ranked[r] = make(map[string][]string)
+		}
+		k := methodsString(all[id].methods)
+		ranked[r][k] = append(ranked[r][k], id)
+	}
+	x := &aclIndex{priority: priority}
+	for r, byMethods := range ranked {
+		var keys []string
+		for k := range byMethods {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ids := byMethods[k]
+			x.ranks[r] = append(x.ranks[r], methodIndex{
+				methods: all[ids[0]].methods,
+				rules:   newRuleIndex(ids, all),
+			})
+		}
+	}
+	return x
+}
+
+// match returns the lowest rule ID of the given rank that matches the request.
+func (x *aclIndex) match(all map[string]RuleAction, rank int, req *Request) (string, bool) {
+	var best string
+	found := false
+	for _, m := range x.ranks[rank] {
+		if !m.methods.contains(req.Method) {
+			continue
+		}
+		if id, ok := m.rules.match(all, req, req.tlsNamesApply(rank)); ok && (!found || id < best) {
+			best, found = id, true
+		}
+	}
+	return best, found
+}
+
+// methodSet is a set of HTTP methods. A nil set contains all methods.
+type methodSet map[string]bool
+
+func (m methodSet) contains(method string) bool {
+	return m == nil || m[method]
+}
+
+// parseMethods parses a comma separated list of HTTP methods. Empty means all
+// methods, and returns nil.
+func parseMethods(s string) methodSet {
+	var ret methodSet
+	for _, m := range strings.Split(s, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" {
+			continue
+		}
+		if ret == nil {
+			ret = make(methodSet)
+		}
+		ret[m] = true
+	}
+	return ret
+}
+
+// methodsString returns the methods in canonical form.
+func methodsString(methods methodSet) string {
+	var l []string
+	for m := range methods {
+		l = append(l, m)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+// Request is a request from squid to decide on.
+type Request struct {
+	Proto, Src, Method, URI string
+
+	// Authenticated user name, if squid supplied one.
+	User string
+
+	// If squid peeked at the TLS handshake, the SNI the client sent, and
+	// the names the server certificate is for.
+	SNI       string
+	CertNames []string
+
+	// When the request was made, for schedules.
+	Time time.Time
+}
+
+// Config is a compiled policy, ready to decide on requests.
+type Config struct {
+	// Sources and the rules that apply to them, most specific first.
+	Sources []sourceRule
+	Rules   map[string]RuleAction
+
+	// User sources, by lowercase user name.
+	Users map[string]*sourceRule
+
+	// What to do if no rule matches, and no group of the sources checked
+	// has a default action.
+	Default Action
+
+	// When a rule, grant or membership next starts or stops being in
+	// effect, and the config must be reloaded. Zero if never.
+	Changes time.Time
+
+	sources *sourceIndex
+
+	// What it was compiled from, for snapshots.
+	src *policy
+}
+
+type Rule interface {
+	Check(proto, src, method, uri string) (bool, error)
+}
+
+// tlsRule is a rule on what squid saw of the TLS handshake, rather than on
+// the request line.
+type tlsRule interface {
+	checkTLS(sni string, certNames []string) bool
+}
+
+// checkRule checks a rule against a canonical request. tls says whether the
+// rule may match on the TLS names too, see Request.tlsNamesApply.
+func checkRule(r Rule, req *Request, tls bool) (bool, error) {
+	if t, ok := r.(tlsRule); ok {
+		return tls && t.checkTLS(req.SNI, req.CertNames), nil
+	}
+	m, err := r.Check(req.Proto, req.Src, req.Method, req.URI)
+	if m || err != nil || !tls {
+		return m, err
+	}
+	if uri := req.sniURI(); uri != "" {
+		return r.Check(req.Proto, req.Src, req.Method, uri)
+	}
+	return false, nil
+}
+
+type RuleAction struct {
+	rule   Rule
+	action Action
+
+	// Type and value as in the database, for explaining decisions.
+	typ, value string
+
+	// Methods the rule applies to, or nil for all methods.
+	methods methodSet
+}
+
+type DomainRule struct {
+	value string
+}
+
+func splitHostPortDefault(s, def string) (string, string) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+		port = def
+	}
+	return host, port
+}
+
+func (d *DomainRule) Check(proto, src, method, uri string) (bool, error) {
+	if proto != "HTTP" {
+		return false, nil
+	}
+	if d.value == "" {
+		return false, nil
+	}
+	p, err := url.Parse(uri)
+	if err != nil {
+		return false, err
+	}
+
+	// If query doesn't have port, assume port 80.
+	ruleHost, rulePort := splitHostPortDefault(d.value, "80")
+	hostOnly, portOnly := splitHostPortDefault(p.Host, "80")
+
+	if portOnly != rulePort && rulePort != "*" {
+		return false, nil
+	}
+
+	// Exact match.
+	if hostOnly == ruleHost {
+		return true, nil
+	}
+
+	// If rule is CIDR, allow anything in it.
+	if _, cidr, err := net.ParseCIDR(ruleHost); err == nil {
+		if ip := net.ParseIP(hostOnly); ip != nil {
+			if cidr.Contains(ip) {
+				return true, nil
+			}
+		}
+	}
+
+	// Domain suffix.
+	if strings.HasPrefix(d.value, ".") {
+		// No extra level.
+		if "."+hostOnly == ruleHost {
+			return true, nil
+		}
+		if strings.HasSuffix(hostOnly, ruleHost) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type RegexRule struct {
+	re *regexp.Regexp
+}
+
+func (d *RegexRule) Check(proto, src, method, uri string) (bool, error) {
+	if proto != "HTTP" {
+		return false, nil
+	}
+	if d.re.MatchString(uri) {
+		return true, nil
+	}
+	return false, nil
+}
+
+type HTTPSRegexRule struct {
+	re *regexp.Regexp
+}
+
+func (d *HTTPSRegexRule) Check(proto, src, method, uri string) (bool, error) {
+	if proto != "NONE" {
+		return false, nil
+	}
+	if d.re.MatchString(uri) {
+		return true, nil
+	}
+	return false, nil
+}
+
+type ExactRule struct {
+	value string
+}
+
+func (d *ExactRule) Check(proto, src, method, uri string) (bool, error) {
+	if proto != "HTTP" {
+		return false, nil
+	}
+	return d.value == uri, nil
+}
+
+// PathPrefixRule matches plain HTTP URLs on a host, with a path at or below a
+// prefix. The value is host[:port]/path, where host is like for DomainRule.
+type PathPrefixRule struct {
+	host   DomainRule
+	prefix string
+}
+
+func newPathPrefixRule(value string) *PathPrefixRule {
+	value = strings.TrimPrefix(value, "http://")
+	host, prefix := value, "/"
+	if n := strings.IndexByte(value, '/'); n >= 0 {
+		host, prefix = value[:n], value[n:]
+	}
+	return &PathPrefixRule{
+		host:   DomainRule{value: canonicalRuleHost(host)},
+		prefix: normalizePath(prefix),
+	}
+}
+
+// validatePathPrefix checks that a path prefix rule value is
+// [http://]host[:port]/path, with .domain instead of host or * as port
+// allowed, so that it can match.
+func validatePathPrefix(value string) error {
+	v := strings.TrimPrefix(value, "http://")
+	if strings.Contains(v, "://") {
+		return fmt.Errorf("only http:// URLs have paths to match")
+	}
+	host, prefix := v, "/"
+	if n := strings.IndexByte(v, '/'); n >= 0 {
+		host, prefix = v[:n], v[n:]
+	}
+	// Any port is allowed with ":*", which isn't one to parse.
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "."), ":*")
+	if host == "" {
+		return fmt.Errorf("no host")
+	}
+	u, err := url.Parse("http://" + host + prefix)
+	if err != nil {
+		return err
+	}
+	if u.Host != host || u.User != nil || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return fmt.Errorf("want [http://]host[:port]/path")
+	}
+	return nil
+}
+
+func (d *PathPrefixRule) Check(proto, src, method, uri string) (bool, error) {
+	if t, err := d.host.Check(proto, src, method, uri); err != nil || !t {
+		return false, err
+	}
+	p, err := url.Parse(uri)
+	if err != nil {
+		return false, err
+	}
+	return hasPathPrefix(normalizePath(p.EscapedPath()), d.prefix), nil
+}
+
+// HostGlobRule matches both plain HTTP and CONNECT requests to hosts matching
+// a glob pattern. The port defaults to 80 for HTTP and 443 for CONNECT.
+type HostGlobRule struct {
+	glob *hostglob.Pattern
+	port string
+}
+
+func newHostGlobRule(value string) (*HostGlobRule, error) {
+	host, port := value, ""
+	if n := strings.LastIndexByte(value, ':'); n >= 0 {
+		host, port = value[:n], value[n+1:]
+	}
+	g, err := hostglob.Compile(host)
+	if err != nil {
+		return nil, err
+	}
+	return &HostGlobRule{glob: g, port: port}, nil
+}
+
+func (d *HostGlobRule) Check(proto, src, method, uri string) (bool, error) {
+	var host, port, def string
+	switch {
+	case proto == "HTTP":
+		p, err := url.Parse(uri)
+		if err != nil {
+			return false, err
+		}
+		host, port = splitHostPortDefault(p.Host, "80")
+		def = "80"
+	case proto == "NONE" && method == "CONNECT":
+		var err error
+		host, port, err = net.SplitHostPort(uri)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse HTTPS host:port %q: %v", uri, err)
+		}
+		def = "443"
+	default:
+		return false, nil
+	}
+	switch d.port {
+	case "*":
+	case "":
+		if port != def {
+			return false, nil
+		}
+	default:
+		if port != d.port {
+			return false, nil
+		}
+	}
+	return d.glob.Match(host), nil
+}
+
+// matchName checks a name against a rule value: a host, or ".domain" for
+// the domain and everything under it. A wildcard certificate name such as
+// "*.example.com" matches the hosts it's valid for.
+func matchName(value, name string) bool {
+	if name == "" {
+		return false
+	}
+	if name == value {
+		return true
+	}
+	if strings.HasPrefix(value, ".") {
+		return "."+name == value || strings.HasSuffix(name, value)
+	}
+	if strings.HasPrefix(name, "*.") {
+		n := strings.IndexByte(value, '.')
+		return n > 0 && value[n:] == name[1:]
+	}
+	return false
+}
+
+// SNIRule matches requests whose TLS client hello had an SNI matching a host
+// or ".domain", whatever the CONNECT was to.
+type SNIRule struct {
+	value string
+}
+
+func (d *SNIRule) Check(proto, src, method, uri string) (bool, error) {
+	return false, nil
+}
+
+func (d *SNIRule) checkTLS(sni string, certNames []string) bool {
+	return matchName(d.value, sni)
+}
+
+// CertNameRule matches requests where the server certificate is for a host
+// or ".domain", by its subject common name or subject alternative names.
+type CertNameRule struct {
+	value string
+}
+
+func (d *CertNameRule) Check(proto, src, method, uri string) (bool, error) {
+	return false, nil
+}
+
+func (d *CertNameRule) checkTLS(sni string, certNames []string) bool {
+	for _, n := range certNames {
+		if matchName(d.value, n) {
+			return true
+		}
+	}
+	return false
+}
+
+type HTTPSDomainRule struct {
+	value string
+}
+
+func (d *HTTPSDomainRule) Check(proto, src, method, uri string) (bool, error) {
+	if proto != "NONE" {
+		return false, nil
+	}
+	if method != "CONNECT" {
+		return false, nil
+	}
+	dhost, dport := splitHostPortDefault(d.value, "443")
+	if dhost == "" {
+		return false, nil
+	}
+	host, port, err := net.SplitHostPort(uri)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse HTTPS host:port %q: %v", uri, err)
+	}
+	if port != dport && dport != "*" {
+		return false, nil
+	}
+	// Exact hostname.
+	if host == dhost {
+		return true, nil
+	}
+
+	// If rule is CIDR, allow those.
+	if _, cidr, err := net.ParseCIDR(dhost); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if cidr.Contains(ip) {
+				return true, nil
+			}
+		}
+	}
+
+	// Domain suffix.
+	if strings.HasPrefix(d.value, ".") {
+		// No extra level.
+		if "."+host == dhost {
+			return true, nil
+		}
+		if strings.HasSuffix(host, dhost) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchGrants returns the first rule that matches req in the active grants.
+func matchGrants(cfg *Config, grants []grant, req *Request) (*grant, string, bool) {
+	// Grants are sorted by priority, so each tier of same priority ACLs is
+	// contiguous.
+	for start := 0; start < len(grants); {
+		end := start + 1
+		for end < len(grants) && grants[end].rules.priority == grants[start].rules.priority {
+			end++
+		}
+		tier := grants[start:end]
+		start = end
+		for r := 0; r < numRanks; r++ {
+			for i := range tier {
+				g := &tier[i]
+				if !g.schedule.Active(req.Time) {
+					continue
+				}
+				if ruleName, found := g.rules.match(cfg.Rules, r, req); found {
+					return g, ruleName, true
+				}
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// Canonicalize returns a copy of req with the URI and TLS names in canonical
+// form, as they're matched against rules.
+func Canonicalize(req *Request) *Request {
+	r := *req
+	r.URI = canonicalURI(req.Proto, req.Method, req.URI)
+	r.SNI = canonicalHost(req.SNI)
+	r.CertNames = nil
+	for _, n := range req.CertNames {
+		r.CertNames = append(r.CertNames, canonicalHost(n))
+	}
+	return &r
+}
+
+// sniURI returns the host:port of a canonical CONNECT request with the host
+// replaced by the SNI, or "" if there's no SNI or it's the same host.
+func (r *Request) sniURI() string {
+	if r.SNI == "" || r.Proto != "NONE" || r.Method != "CONNECT" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(r.URI)
+	if err != nil || host == r.SNI {
+		return ""
+	}
+	return net.JoinHostPort(r.SNI, port)
+}
+
+// tlsNamesApply reports whether rules with an action of the given rank may
+// match a canonical request on its SNI and certificate names. The client
+// chooses the SNI, so for a CONNECT to a name they can only add blocks, or
+// a forged SNI would get any destination allowed. For a CONNECT to an IP
+// literal they're the only names there are.
+func (r *Request) tlsNamesApply(rank int) bool {
+	if rank == actionRank(ActionBlock) {
+		return true
+	}
+	if r.Proto != "NONE" || r.Method != "CONNECT" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.URI)
+	return err == nil && net.ParseIP(host) != nil
+}
+
+// lookupSources returns the sources that apply to a request, in the order
+// they're checked: the user's, then those containing the address.
+func (cfg *Config) lookupSources(user string, a net.IP) []*sourceRule {
+	var srcs []*sourceRule
+	if user != "" {
+		if u := cfg.Users[strings.ToLower(user)]; u != nil {
+			srcs = append(srcs, u)
+		}
+	}
+	for _, n := range cfg.sources.lookup(cfg.Sources, a) {
+		srcs = append(srcs, &cfg.Sources[n])
+	}
+	return srcs
+}
+
+// Decision is the outcome of evaluating a request, and why.
+type Decision struct {
+	Found  bool
+	Action Action
+
+	// What matched, if anything.
+	SourceID   string
+	GroupID    string
+	ACLID      string
+	ACLComment string
+	RuleID     string
+
+	// If no rule matched, the group whose default action applied, if any.
+	DefaultGroup string
+
+	// When a schedule change may change the decision. Zero if none is
+	// coming up.
+	Expires time.Time
+
+	// The deciding group is monitored, or if no rule matched, a source
+	// checked is in a monitored group. Blocks should then be logged but
+	// not enforced. GroupID and SourceID are set to the monitored ones.
+	Monitor bool
+}
+
+// decide returns 'match found', 'action to take', error
+func decide(cfg *Config, req *Request) (bool, Action, error) {
+	d, err := Evaluate(cfg, req)
+	return d.Found, d.Action, err
+}
+
+// Evaluate decides what to do with a request, and says why.
+//
+// The URI is canonicalized before matching, the same way as rule values. A
+// CONNECT to an IP literal with an SNI matches rules for either the IP or the
+// SNI, so that rules by name apply to it. For a CONNECT to a name, the SNI
+// and certificate names only match block rules, since the client could
+// forge them to get allowed.
+//
+// If squid supplied a user name, that user's source is checked first. Then
+// sources containing src are checked most specific first. The first source
+// with a matching rule decides; its ACLs are checked as follows, skipping
+// grants whose schedule isn't active:
+//
+// ACLs are checked in tiers of the same priority, highest priority first. The
+// first tier with a matching rule decides. Within a tier, a matching block rule
+// beats a matching ignore rule, which beats a matching allow rule. Ties are
+// broken by ACL ID, then rule ID. Rules restricted to some methods don't match
+// requests with other methods.
+//
+// If no rule matches, the first source checked that's in a group with a
+// default action decides with it; block beats allow if it's in several.
+// Otherwise the policy's default applies.
+//
+// If the deciding rule's group is monitored, the decision is marked Monitor.
+// So is a request no rule matched, if any source checked is in a monitored
+// group, since a group being onboarded may have no ACLs yet.
+func Evaluate(cfg *Config, req *Request) (Decision, error) {
+	return EvaluateCanonical(cfg, Canonicalize(req))
+}
+
+// EvaluateCanonical is Evaluate for a request already returned by
+// Canonicalize, for callers that need the canonical request themselves.
+func EvaluateCanonical(cfg *Config, req *Request) (Decision, error) {
+	// Special case this because net/url can't parse these.
+	if strings.HasPrefix(req.URI, "cache_object://") {
+		return Decision{Found: true, Action: ActionIgnore}, nil
+	}
+
+	source := net.ParseIP(req.Src)
+	if source == nil {
+		return Decision{Action: ActionNone}, fmt.Errorf("source is not a valid address: %q", req.Src)
+	}
+	srcs := cfg.lookupSources(req.User, source)
+	// Any schedule change in the sources checked, including the deciding
+	// one, could change the decision. So could any rule, grant or
+	// membership starting or ending.
+	expires := cfg.Changes
+	for _, s := range srcs {
+		for _, g := range s.grants {
+			if t, ok := g.schedule.Next(req.Time); ok && (expires.IsZero() || t.Before(expires)) {
+				expires = t
+			}
+		}
+		if g, ruleName, found := matchGrants(cfg, s.grants, req); found {
+			return Decision{
+				Found:      true,
+				Action:     cfg.Rules[ruleName].action,
+				SourceID:   s.id,
+				GroupID:    g.group,
+				ACLID:      g.acl,
+				ACLComment: g.rules.comment,
+				RuleID:     ruleName,
+				Expires:    expires,
+				Monitor:    g.monitor,
+			}, nil
+		}
+	}
+	d := Decision{Action: cfg.Default, Expires: expires}
+	for _, s := range srcs {
+		if s.deflt != "" {
+			d.Action, d.DefaultGroup = s.deflt, s.defaultGroup
+			break
+		}
+	}
+	if d.Action == ActionAllow {
+		return d, nil
+	}
+	for _, s := range srcs {
+		if len(s.monitor) > 0 {
+			d.Monitor = true
+			d.SourceID = s.id
+			d.GroupID = s.monitor[0]
+			break
+		}
+	}
+	return d, nil
+}
+
+func parseMask(s string) (source, error) {
+	re := regexp.MustCompile(`^([0-9a-fA-F:.]+)/([0-9a-fA-F:.]+)$`)
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("not a host match")
+	}
+	a := net.ParseIP(m[1])
+	if a == nil {
+		return nil, fmt.Errorf("not a valid address: %q", m[1])
+	}
+	b := net.ParseIP(m[2])
+	if b == nil {
+		return nil, fmt.Errorf("not a valid address: %q", m[2])
+	}
+	return &sourceMask{host: a, mask: b}, nil
+}
+
+// policy is the policy as stored in the database, before it's compiled into a
+// Config.
+type policy struct {
+	Sources     []policySource
+	Groups      []policyGroup
+	Members     []policyMember
+	GroupAccess []policyGroupAccess
+	ACLs        []policyACL
+	ACLRules    []policyACLRule
+	Rules       []policyRule
+
+	// The default_action setting, or empty if not set.
+	DefaultAction string
+}
+
+type policySource struct {
+	SourceID string
+	Source   string
+}
+
+type policyGroup struct {
+	GroupID       string
+	Monitor       bool
+	DefaultAction string
+}
+
+type policyMember struct {
+	SourceID string
+	GroupID  string
+	validity
+}
+
+type policyGroupAccess struct {
+	GroupID  string
+	ACLID    string
+	Schedule string
+	validity
+}
+
+type policyACL struct {
+	ACLID    string
+	Priority int
+	Comment  string
+}
+
+type policyACLRule struct {
+	ACLID  string
+	RuleID string
+}
+
+type policyRule struct {
+	RuleID  string
+	Type    string
+	Value   string
+	Action  string
+	Methods string
+	validity
+}
+
+// validity is when a rule, grant or membership is in effect, as Unix times.
+// Zero means no limit.
+type validity struct {
+	ValidFrom  int64
+	ValidUntil int64
+}
+
+func (v validity) active(now time.Time) bool {
+	t := now.Unix()
+	return (v.ValidFrom == 0 || v.ValidFrom <= t) && (v.ValidUntil == 0 || t < v.ValidUntil)
+}
+
+// next returns when v next starts or stops being in effect after now.
+func (v validity) next(now time.Time) (time.Time, bool) {
+	t := now.Unix()
+	switch {
+	case v.ValidFrom > t:
+		return time.Unix(v.ValidFrom, 0), true
+	case v.ValidUntil > t:
+		return time.Unix(v.ValidUntil, 0), true
+	}
+	return time.Time{}, false
+}
+
+// scan sets v from nullable database columns.
+func (v *validity) scan(from, until sql.NullInt64) {
+	v.ValidFrom = from.Int64
+	v.ValidUntil = until.Int64
+}
+
+// queryRows runs query and calls f for every row.
+func queryRows(db *sql.DB, query string, f func(*sql.Rows) error) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := f(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func parseSource(src string) (source, error) {
+	_, t, err := net.ParseCIDR(src)
+	if err != nil {
+		return parseMask(src)
+	}
+	s := sourceNet(*t)
+	return &s, nil
+}
+
+func loadPolicy(db *sql.DB) (*policy, error) {
+	p := &policy{}
+	if err := queryRows(db, `SELECT source_id, source FROM sources ORDER BY source`, func(rows *sql.Rows) error {
+		var e policySource
+		if err := rows.Scan(&e.SourceID, &e.Source); err != nil {
+			return err
+		}
+		p.Sources = append(p.Sources, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := queryRows(db, `SELECT group_id, monitor, default_action FROM groups`, func(rows *sql.Rows) error {
+		var e policyGroup
+		var deflt sql.NullString
+		if err := rows.Scan(&e.GroupID, &e.Monitor, &deflt); err != nil {
+			return err
+		}
+		e.DefaultAction = deflt.String
+		p.Groups = append(p.Groups, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := queryRows(db, `SELECT source_id, group_id, valid_from, valid_until FROM members`, func(rows *sql.Rows) error {
+		var e policyMember
+		var from, until sql.NullInt64
+		if err := rows.Scan(&e.SourceID, &e.GroupID, &from, &until); err != nil {
+			return err
+		}
+		e.scan(from, until)
+		p.Members = append(p.Members, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := queryRows(db, `SELECT group_id, acl_id, schedule, valid_from, valid_until FROM groupaccess ORDER BY acl_id, schedule`, func(rows *sql.Rows) error {
+		var e policyGroupAccess
+		var sched sql.NullString
+		var from, until sql.NullInt64
+		if err := rows.Scan(&e.GroupID, &e.ACLID, &sched, &from, &until); err != nil {
+			return err
+		}
+		e.Schedule = sched.String
+		e.scan(from, until)
+		p.GroupAccess = append(p.GroupAccess, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := queryRows(db, `SELECT acl_id, priority, comment FROM acls`, func(rows *sql.Rows) error {
+		var e policyACL
+		var comment sql.NullString
+		if err := rows.Scan(&e.ACLID, &e.Priority, &comment); err != nil {
+			return err
+		}
+		e.Comment = comment.String
+		p.ACLs = append(p.ACLs, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := queryRows(db, `SELECT acl_id, rule_id FROM aclrules ORDER BY acl_id, rule_id`, func(rows *sql.Rows) error {
+		var e policyACLRule
+		if err := rows.Scan(&e.ACLID, &e.RuleID); err != nil {
+			return err
+		}
+		p.ACLRules = append(p.ACLRules, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := queryRows(db, `SELECT rule_id, type, value, action, methods, valid_from, valid_until FROM rules`, func(rows *sql.Rows) error {
+		var e policyRule
+		var methods sql.NullString
+		var from, until sql.NullInt64
+		if err := rows.Scan(&e.RuleID, &e.Type, &e.Value, &e.Action, &methods, &from, &until); err != nil {
+			return err
+		}
+		e.Methods = methods.String
+		e.scan(from, until)
+		p.Rules = append(p.Rules, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow(`SELECT value FROM settings WHERE name='default_action'`).Scan(&p.DefaultAction); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseDefaultAction parses a default action setting. Empty means none.
+func parseDefaultAction(s string) (Action, error) {
+	switch a := Action(s); a {
+	case "", ActionAllow, ActionBlock:
+		return a, nil
+	}
+	return "", fmt.Errorf("bad default action %q, want allow or block", s)
+}
+
+func compileRule(typ, val string) (Rule, error) {
+	switch typ {
+	case "https-domain":
+		return &HTTPSDomainRule{value: canonicalRuleHost(val)}, nil
+	case "domain":
+		return &DomainRule{value: canonicalRuleHost(val)}, nil
+	case "exact":
+		if c, err := canonicalURL(val); err == nil {
+			val = c
+		}
+		return &ExactRule{value: val}, nil
+	case "path-prefix":
+		return newPathPrefixRule(val), nil
+	case "host-glob":
+		r, err := newHostGlobRule(val)
+		if err != nil {
+			return nil, fmt.Errorf("compiling host glob %q: %v", val, err)
+		}
+		return r, nil
+	case "regex":
+		x, err := regexp.Compile("^" + val + "$")
+		if err != nil {
+			return nil, fmt.Errorf("compiling regex %q: %v", val, err)
+		}
+		return &RegexRule{re: x}, nil
+	case "https-regex":
+		x, err := regexp.Compile("^" + val + "$")
+		if err != nil {
+			return nil, fmt.Errorf("compiling regex %q: %v", val, err)
+		}
+		return &HTTPSRegexRule{re: x}, nil
+	case "sni":
+		return &SNIRule{value: canonicalRuleHost(val)}, nil
+	case "cert-name":
+		return &CertNameRule{value: canonicalRuleHost(val)}, nil
+	default:
+		return nil, fmt.Errorf("unknown rule type %q", typ)
+	}
+}
+
+// ValidateRule returns an error if a rule value isn't valid for its type, so
+// that the policy would fail to load, or can never match.
+func ValidateRule(typ, val string) error {
+	if typ == "path-prefix" {
+		if err := validatePathPrefix(val); err != nil {
+			return fmt.Errorf("bad path prefix %q: %v", val, err)
+		}
+	}
+	_, err := compileRule(typ, val)
+	return err
+}
+
+// compile turns the policy into indexed structures for decide. Rules, grants
+// and memberships not in effect at now are left out.
+func compile(p *policy, now time.Time) (*Config, error) {
+	cfg := &Config{
+		Rules:   make(map[string]RuleAction),
+		Users:   make(map[string]*sourceRule),
+		Default: ActionDefault,
+		src:     p,
+	}
+	if a, err := parseDefaultAction(p.DefaultAction); err != nil {
+		return nil, err
+	} else if a != "" {
+		cfg.Default = a
+	}
+	// valid says if v is in effect, and notes when it changes.
+	valid := func(v validity) bool {
+		if t, ok := v.next(now); ok && (cfg.Changes.IsZero() || t.Before(cfg.Changes)) {
+			cfg.Changes = t
+		}
+		return v.active(now)
+	}
+	for _, r := range p.Rules {
+		if !valid(r.validity) {
+			continue
+		}
+		rule, err := compileRule(r.Type, r.Value)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Rules[r.RuleID] = RuleAction{
+			rule:    rule,
+			action:  Action(r.Action),
+			typ:     r.Type,
+			value:   r.Value,
+			methods: parseMethods(r.Methods),
+		}
+	}
+
+	// One index per ACL, shared by all sources that have access to it.
+	aclRules := make(map[string][]string)
+	for _, e := range p.ACLRules {
+		if _, ok := cfg.Rules[e.RuleID]; !ok {
+			continue
+		}
+		aclRules[e.ACLID] = append(aclRules[e.ACLID], e.RuleID)
+	}
+	acls := make(map[string]policyACL)
+	for _, e := range p.ACLs {
+		acls[e.ACLID] = e
+	}
+	indexes := make(map[string]*aclIndex)
+	for acl, rules := range aclRules {
+		indexes[acl] = newACLIndex(acls[acl].Priority, rules, cfg.Rules)
+		indexes[acl].comment = acls[acl].Comment
+	}
+
+	monitored := make(map[string]bool)
+	defaults := make(map[string]Action)
+	for _, g := range p.Groups {
+		monitored[g.GroupID] = g.Monitor
+		a, err := parseDefaultAction(g.DefaultAction)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %v", g.GroupID, err)
+		}
+		if a != "" {
+			defaults[g.GroupID] = a
+		}
+	}
+
+	groupGrants := make(map[string][]grant)
+	for _, e := range p.GroupAccess {
+		if !valid(e.validity) || indexes[e.ACLID] == nil {
+			continue
+		}
+		sched, err := schedule.Parse(e.Schedule)
+		if err != nil {
+			log.Printf("Bad schedule for group %q ACL %q, ignoring grant: %v", e.GroupID, e.ACLID, err)
+			continue
+		}
+		groupGrants[e.GroupID] = append(groupGrants[e.GroupID], grant{
+			group:    e.GroupID,
+			acl:      e.ACLID,
+			schedule: sched,
+			rules:    indexes[e.ACLID],
+			monitor:  monitored[e.GroupID],
+		})
+	}
+	sourceGrants := make(map[string][]grant)
+	sourceMonitor := make(map[string][]string)
+	sourceDefault := make(map[string]*sourceRule)
+	seen := make(map[[3]string]int)
+	for _, m := range p.Members {
+		if !valid(m.validity) {
+			continue
+		}
+		if monitored[m.GroupID] {
+			sourceMonitor[m.SourceID] = append(sourceMonitor[m.SourceID], m.GroupID)
+		}
+		if a, ok := defaults[m.GroupID]; ok {
+			if sourceDefault[m.SourceID] == nil {
+				sourceDefault[m.SourceID] = &sourceRule{}
+			}
+			sourceDefault[m.SourceID].addDefault(a, m.GroupID)
+		}
+		for _, g := range groupGrants[m.GroupID] {
+			k := [3]string{m.SourceID, g.acl, g.schedule.String()}
+			if i, ok := seen[k]; ok {
+				// Several groups grant the source the same ACL. Keep
+				// an enforcing one over a monitored one, then the
+				// lowest group ID, so that it doesn't depend on the
+				// order of members.
+				old := &sourceGrants[m.SourceID][i]
+				if (old.monitor && !g.monitor) || (old.monitor == g.monitor && g.group < old.group) {
+					*old = g
+				}
+				continue
+			}
+			seen[k] = len(sourceGrants[m.SourceID])
+			sourceGrants[m.SourceID] = append(sourceGrants[m.SourceID], g)
+		}
+	}
+
+	for _, e := range p.Sources {
+		grants := sourceGrants[e.SourceID]
+		monitor := sourceMonitor[e.SourceID]
+		sort.Strings(monitor)
+		deflt := sourceDefault[e.SourceID]
+		if deflt == nil {
+			deflt = &sourceRule{}
+		}
+		if len(grants) == 0 && len(monitor) == 0 && deflt.deflt == "" {
+			continue
+		}
+		sort.Stable(byPriority(grants))
+		if strings.HasPrefix(e.Source, userPrefix) {
+			u := sourceUser(strings.ToLower(e.Source[len(userPrefix):]))
+			if r := cfg.Users[string(u)]; r != nil {
+				// Same user with different case. Merge them.
+				r.grants = append(r.grants, grants...)
+				sort.Stable(byPriority(r.grants))
+				r.monitor = append(r.monitor, monitor...)
+				if deflt.deflt != "" {
+					r.addDefault(deflt.deflt, deflt.defaultGroup)
+				}
+			} else {
+				cfg.Users[string(u)] = &sourceRule{id: e.SourceID, source: u, grants: grants, monitor: monitor, deflt: deflt.deflt, defaultGroup: deflt.defaultGroup}
+			}
+			continue
+		}
+		s, err := parseSource(e.Source)
+		if err != nil {
+			log.Printf("%q is not valid CIDR: %v", e.Source, err)
+			continue
+		}
+		cfg.Sources = append(cfg.Sources, sourceRule{id: e.SourceID, source: s, grants: grants, monitor: monitor, deflt: deflt.deflt, defaultGroup: deflt.defaultGroup})
+	}
+	sort.Stable(sort.Reverse(byPrefixLen(cfg.Sources)))
+	cfg.sources = newSourceIndex(cfg.Sources)
+	return cfg, nil
+}
+
+// Load loads the policy from the database and compiles it.
+func Load(db *sql.DB) (*Config, error) {
+	p, err := loadPolicy(db)
+	if err != nil {
+		return nil, err
+	}
+	return compile(p, time.Now())
+}
+
+// byPriority sorts grants highest priority first, then by ACL ID.
+type byPriority []grant
+
+func (a byPriority) Len() int      { return len(a) }
+func (a byPriority) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPriority) Less(i, j int) bool {
+	if a[i].rules.priority != a[j].rules.priority {
+		return a[i].rules.priority > a[j].rules.priority
+	}
+	return a[i].acl < a[j].acl
+}
+
+type byPrefixLen []sourceRule
+
+func (a byPrefixLen) Len() int      { return len(a) }
+func (a byPrefixLen) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPrefixLen) Less(i, j int) bool {
+	return a[i].source.PrefixLen() < a[j].source.PrefixLen()
+}
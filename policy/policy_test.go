@@ -0,0 +1,1254 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	sqliteBin = "/usr/bin/sqlite3"
+
+	testDB *sql.DB
+)
+
+func TestMain(m *testing.M) {
+	var res int
+	func() {
+		dir, err := ioutil.TempDir("", "squidwarden_test_")
+		if err != nil {
+			panic(err)
+		}
+
+		defer os.RemoveAll(dir) // clean up
+		dbFile := path.Join(dir, "sqidwarden_test.sqlite")
+
+		executeSQL := func(fn string) {
+			f, err := os.Open(fn)
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+			var e bytes.Buffer
+			cmd := exec.Command(sqliteBin, dbFile)
+			cmd.Stdin = f
+			cmd.Stderr = &e
+			if err := cmd.Run(); err != nil {
+				log.Fatalf("sqlite setup reading %q: %v, stderr %q", fn, err, e.String())
+			}
+		}
+
+		executeSQL("../sqlite.schema")
+		executeSQL("../testdata/test.sql")
+
+		testDB, err = sql.Open("sqlite3", dbFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer testDB.Close()
+		res = m.Run()
+	}()
+	os.Exit(res)
+}
+
+func loadConfig() (*Config, error) {
+	return Load(testDB)
+}
+
+func TestOrder(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := []string{
+		"127.0.0.1/32",
+		"127.0.0.3/32",
+		"127.0.0.0/8",
+		"0.0.0.0/1",
+		"129.99.0.1/255.255.0.255",
+		"::1234:5678/::ffff:ffff",
+	}
+
+	if got, want := len(cfg.Sources), len(ss); got != want {
+		t.Fatalf("Got %d sources, want %d", got, want)
+	}
+	for n, s := range ss {
+		if got, want := cfg.Sources[n].source.String(), s; got != want {
+			t.Errorf("Got %dth entry %v, want %v", n, got, want)
+		}
+	}
+}
+
+type decisionTest struct {
+	proto, src, method, uri string
+	err                     bool
+	want                    bool
+}
+
+func (t *decisionTest) request() *Request {
+	return &Request{
+		Proto:  t.proto,
+		Src:    t.src,
+		Method: t.method,
+		URI:    t.uri,
+		Time:   time.Now(),
+	}
+}
+
+var decisionTests = []decisionTest{
+	// domain
+	{"HTTP", "127.0.0.1", "GET", "http://www.unencrypted.habets.se/", false, true},
+	{"HTTP", "127.0.0.1", "GET", "http://www.unencrypted.habets.se:8080/", false, false},
+	{"HTTP", "128.0.0.1", "GET", "http://www.unencrypted.habets.se/", false, false},
+	{"HTTP", "127.0.0.1", "GET", "http://www.unencrypted.habets.co.uk/", false, false},
+
+	// CIDR
+	{"HTTP", "127.0.0.1", "GET", "http://9.1.2.3/blah", false, true},
+	{"HTTP", "127.0.0.1", "GET", "http://9.1.2.3:8080/blah", false, true},
+	{"HTTP", "127.0.0.1", "GET", "http://9.1.2.3:8081/blah", false, false},
+	{"HTTP", "127.0.0.1", "GET", "http://9.2.2.3/blah", false, false},
+	{"NONE", "127.0.0.1", "CONNECT", "9.2.2.3:443", false, true},
+	{"NONE", "127.0.0.1", "CONNECT", "9.2.2.3:8443", false, true},
+	{"NONE", "127.0.0.1", "CONNECT", "9.2.2.3:9443", false, false},
+	{"NONE", "127.0.0.1", "CONNECT", "9.1.2.3:443", false, false},
+
+	// Wildcard port.
+	{"HTTP", "127.0.0.1", "GET", "http://9.9.0.1/blah", false, true},
+	{"HTTP", "127.0.0.1", "GET", "http://9.9.0.1:80/blah", false, true},
+	{"HTTP", "127.0.0.1", "GET", "http://9.9.0.1:8080/blah", false, true},
+	{"NONE", "127.0.0.1", "CONNECT", "9.9.0.1", false, false}, // TODO
+	{"NONE", "127.0.0.1", "CONNECT", "9.9.0.1:443", false, true},
+	{"NONE", "127.0.0.1", "CONNECT", "9.9.0.1:8443", false, true},
+
+	// Blocked for local, not for bob.
+	// Even though bob is part of local too.
+	{"NONE", "127.0.0.1", "CONNECT", "9.10.0.1:443", false, true},
+	{"NONE", "127.0.0.2", "CONNECT", "9.10.0.1:443", false, false},
+
+	// domain for literals. Domain with missing port means port 80.
+	{"HTTP", "127.0.0.1", "GET", "http://1.2.3.4/path/blah", false, true},
+	{"HTTP", "127.0.0.1", "GET", "http://1.2.3.4:80/path/blah", false, true},
+	{"HTTP", "127.0.0.1", "GET", "http://1.2.3.4:8080/path/blah", false, false},
+	{"HTTP", "127.0.0.1", "GET", "http://1.2.3.5/path/blah", false, false},
+	{"HTTP", "127.0.0.1", "GET", "http://1.2.3.5:80/path/blah", false, false},
+	{"HTTP", "127.0.0.1", "GET", "http://1.2.3.5:8080/path/blah", false, true},
+
+	// regex
+	{"HTTP", "127.0.0.1", "GET", "http://www.google.co.uk/url?foo=bar", false, true},
+	{"HTTP", "127.0.0.1", "GET", "http://www.google.co.uk/", false, false},
+
+	// https-domain
+	{"NONE", "127.0.0.1", "CONNECT", "www.habets.se:443", false, true},
+	{"NONE", "127.0.0.1", "CONNECT", "www.habets.se:8443", false, false},
+	{"NONE", "127.0.0.1", "CONNECT", "www.habets.co.uk:443", false, false},
+	{"NONE", "127.0.0.1", "CONNECT", "www.port.com:443", false, false},
+	{"NONE", "127.0.0.1", "CONNECT", "www.port.com:8443", false, true},
+	{"NONE", "127.0.0.1", "CONNECT", "www.github.com:443", false, false},
+	{"NONE", "127.0.0.1", "CONNECT", "github.com:443", false, true},
+
+	// IPv6 mask
+	{"HTTP", "2001:db8::1234:5678", "GET", "http://www.unencrypted.habets.se/", false, true},
+	{"HTTP", "2001:db8::1234:5679", "GET", "http://www.unencrypted.habets.se/", false, false},
+
+	// IPv4 mask
+	{"HTTP", "129.99.0.1", "GET", "http://www.unencrypted.habets.se/", false, true},
+	{"HTTP", "129.99.99.1", "GET", "http://www.unencrypted.habets.se/", false, true},
+	{"HTTP", "129.99.0.2", "GET", "http://www.unencrypted.habets.se/", false, false},
+	{"HTTP", "129.99.99.2", "GET", "http://www.unencrypted.habets.se/", false, false},
+}
+
+func TestDecisions(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range decisionTests {
+		v, action, err := decide(cfg, test.request())
+		if action == ActionIgnore {
+			v = false
+		}
+		if err != nil != test.err {
+			t.Errorf("Want err %v, got %v for %+v", test.err, err, test)
+		} else {
+			if v != test.want {
+				t.Errorf("Wrong results %t (want %t) for %+v", v, test.want, test)
+			}
+		}
+	}
+}
+
+// decideLinear is the straightforward implementation of decide, checking every
+// rule one by one. The indexes must give the same results.
+func decideLinear(cfg *Config, req *Request) (bool, Action, error) {
+	if strings.HasPrefix(req.URI, "cache_object://") {
+		return true, ActionIgnore, nil
+	}
+	req = Canonicalize(req)
+	source := net.ParseIP(req.Src)
+	if source == nil {
+		return false, ActionNone, fmt.Errorf("source is not a valid address: %q", req.Src)
+	}
+	var srcs []*sourceRule
+	if u := cfg.Users[strings.ToLower(req.User)]; req.User != "" && u != nil {
+		srcs = append(srcs, u)
+	}
+	for n := range cfg.Sources {
+		if cfg.Sources[n].source.Contains(source) {
+			srcs = append(srcs, &cfg.Sources[n])
+		}
+	}
+	for _, rs := range srcs {
+		// Find the matching rule with the highest ACL priority, and among those
+		// the one whose action ranks first.
+		var best *RuleAction
+		bestPrio := 0
+		for _, g := range rs.grants {
+			if !g.schedule.Active(req.Time) {
+				continue
+			}
+			for _, ms := range g.rules.ranks {
+				for _, m := range ms {
+					for _, ruleName := range m.rules.rules {
+						rule := cfg.Rules[ruleName]
+						if !rule.methods.contains(req.Method) {
+							continue
+						}
+						t, err := checkRule(rule.rule, req, req.tlsNamesApply(actionRank(rule.action)))
+						if err != nil || !t {
+							continue
+						}
+						p := g.rules.priority
+						if best == nil || p > bestPrio || (p == bestPrio && actionRank(rule.action) < actionRank(best.action)) {
+							best = &rule
+							bestPrio = p
+						}
+					}
+				}
+			}
+		}
+		if best != nil {
+			return true, best.action, nil
+		}
+	}
+	return false, cfg.Default, nil
+}
+
+func TestIndexMatchesLinear(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := append([]decisionTest{}, decisionTests...)
+	for _, src := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "10.0.0.1", "::1", "::1234:5678"} {
+		for _, uri := range []string{
+			"http://habets.se/",
+			"http://.unencrypted.habets.se/",
+			"http://unencrypted.habets.se:80/",
+			"http://xunencrypted.habets.se/",
+			"http://9.1.2.255:8080/",
+			"http://[::1]/",
+			"http://www.google.co.uk/url?",
+			"http://mail.google.com/",
+			"http://paste.example.com/",
+			"http://mirror.example.com/",
+		} {
+			for _, method := range []string{"GET", "POST"} {
+				tests = append(tests, decisionTest{proto: "HTTP", src: src, method: method, uri: uri})
+			}
+		}
+		for _, uri := range []string{
+			"habets.se:443",
+			"xhabets.se:443",
+			"a.b.port.com:8443",
+			"9.10.0.1:1",
+			"9.2.2.0:8443",
+			"github.com",
+			"mail.google.com:443",
+		} {
+			tests = append(tests, decisionTest{proto: "NONE", src: src, method: "CONNECT", uri: uri})
+		}
+	}
+	for _, test := range tests {
+		v1, a1, err1 := decide(cfg, test.request())
+		v2, a2, err2 := decideLinear(cfg, test.request())
+		if v1 != v2 || a1 != a2 || (err1 != nil) != (err2 != nil) {
+			t.Errorf("%+v: indexed gave %t %s %v, linear %t %s %v", test, v1, a1, err1, v2, a2, err2)
+		}
+	}
+}
+
+func TestRegexSet(t *testing.T) {
+	var res []*regexp.Regexp
+	for _, v := range []string{
+		`http://a/.*`,
+		`(x)|.*b/`, // Top level alternative, only anchored on one side.
+		`http://(a|b)/(.*)`,
+		`.*c/`,
+	} {
+		res = append(res, regexp.MustCompile("^"+v+"$"))
+	}
+	s := newRegexSet(res, []int{0, 1, 2, 3})
+	if s.re == nil {
+		t.Fatal("Failed to combine regexes")
+	}
+	for _, test := range []struct {
+		in   string
+		want int
+	}{
+		{"http://a/foo", 0},
+		{"http://b/", 1},
+		{"http://b/foo", 2},
+		{"http://c/", 3},
+		{"xyz", 1},
+		{"http://d/", 100},
+	} {
+		if got := s.lookup(test.in, 100); got != test.want {
+			t.Errorf("%q: got %d, want %d", test.in, got, test.want)
+		}
+	}
+}
+
+// benchmarkPolicy returns a policy with n domain and https-domain rules, and
+// n/100 regexes, all granted to one network.
+func benchmarkPolicy(n int) *policy {
+	p := &policy{
+		Sources: []policySource{{SourceID: "s", Source: "10.0.0.0/8"}},
+		Members: []policyMember{{SourceID: "s", GroupID: "g"}},
+	}
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("s%d", i)
+		p.Sources = append(p.Sources, policySource{SourceID: id, Source: fmt.Sprintf("10.%d.0.0/16", i)})
+		p.Members = append(p.Members, policyMember{SourceID: id, GroupID: "g"})
+	}
+	for a := 0; a < 10; a++ {
+		acl := fmt.Sprintf("acl%d", a)
+		p.GroupAccess = append(p.GroupAccess, policyGroupAccess{GroupID: "g", ACLID: acl})
+		for i := a; i < n; i += 10 {
+			for _, r := range []policyRule{
+				{RuleID: fmt.Sprintf("d%d", i), Type: "domain", Value: fmt.Sprintf(".domain%d.example.com", i), Action: "allow"},
+				{RuleID: fmt.Sprintf("h%d", i), Type: "https-domain", Value: fmt.Sprintf("www.domain%d.example.com", i), Action: "allow"},
+			} {
+				p.Rules = append(p.Rules, r)
+				p.ACLRules = append(p.ACLRules, policyACLRule{ACLID: acl, RuleID: r.RuleID})
+			}
+			if i%100 == 0 {
+				r := policyRule{RuleID: fmt.Sprintf("r%d", i), Type: "regex", Value: fmt.Sprintf(`http://regex%d\.example\.com/.*`, i), Action: "allow"}
+				p.Rules = append(p.Rules, r)
+				p.ACLRules = append(p.ACLRules, policyACLRule{ACLID: acl, RuleID: r.RuleID})
+			}
+		}
+	}
+	return p
+}
+
+func benchmarkDecide(b *testing.B, f func(*Config, *Request) (bool, Action, error)) {
+	cfg, err := compile(benchmarkPolicy(20000), time.Now())
+	if err != nil {
+		b.Fatal(err)
+	}
+	reqs := []decisionTest{
+		{proto: "HTTP", src: "10.1.2.3", method: "GET", uri: "http://www.domain19999.example.com/"},
+		{proto: "HTTP", src: "10.1.2.3", method: "GET", uri: "http://regex19900.example.com/foo"},
+		{proto: "HTTP", src: "10.1.2.3", method: "GET", uri: "http://not.example.com/"},
+		{proto: "NONE", src: "10.1.2.3", method: "CONNECT", uri: "www.domain19999.example.com:443"},
+		{proto: "NONE", src: "10.1.2.3", method: "CONNECT", uri: "not.example.com:443"},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := f(cfg, reqs[i%len(reqs)].request()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecide(b *testing.B)       { benchmarkDecide(b, decide) }
+func BenchmarkDecideLinear(b *testing.B) { benchmarkDecide(b, decideLinear) }
+
+func TestSchedule(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2016-01-04 is a Monday.
+	for _, test := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2016, 1, 4, 15, 59, 0, 0, time.Local), false},
+		{time.Date(2016, 1, 4, 16, 0, 0, 0, time.Local), true},
+		{time.Date(2016, 1, 4, 20, 0, 0, 0, time.Local), false},
+		{time.Date(2016, 1, 9, 10, 0, 0, 0, time.Local), true},
+	} {
+		req := &Request{
+			Proto:  "NONE",
+			Src:    "127.0.0.3",
+			Method: "CONNECT",
+			URI:    "games.example.com:443",
+			Time:   test.t,
+		}
+		if got, _, err := decide(cfg, req); err != nil {
+			t.Errorf("%v: %v", test.t, err)
+		} else if got != test.want {
+			t.Errorf("%v: got %t, want %t", test.t, got, test.want)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		proto, method, uri string
+		want               Action
+	}{
+		// Same priority: block beats allow.
+		{"HTTP", "GET", "http://www.google.com/", ActionAllow},
+		{"HTTP", "GET", "http://mail.google.com/", ActionBlock},
+		{"NONE", "CONNECT", "www.google.com:443", ActionAllow},
+
+		// Higher priority ACL allows what the lower one blocks.
+		{"NONE", "CONNECT", "mail.google.com:443", ActionAllow},
+	} {
+		req := &Request{
+			Proto:  test.proto,
+			Src:    "127.0.0.3",
+			Method: test.method,
+			URI:    test.uri,
+			Time:   time.Now(),
+		}
+		for _, f := range []func(*Config, *Request) (bool, Action, error){decide, decideLinear} {
+			if found, got, err := f(cfg, req); err != nil {
+				t.Errorf("%s: %v", test.uri, err)
+			} else if !found || got != test.want {
+				t.Errorf("%s: got %t %q, want %q", test.uri, found, got, test.want)
+			}
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		method, uri string
+		found       bool
+		want        Action
+	}{
+		{"GET", "http://paste.example.com/", true, ActionAllow},
+		{"POST", "http://paste.example.com/", true, ActionBlock},
+		{"PUT", "http://paste.example.com/", true, ActionBlock},
+		{"GET", "http://mirror.example.com/", true, ActionAllow},
+		{"HEAD", "http://mirror.example.com/", true, ActionAllow},
+		{"POST", "http://mirror.example.com/", false, ActionDefault},
+	} {
+		req := &Request{
+			Proto:  "HTTP",
+			Src:    "127.0.0.3",
+			Method: test.method,
+			URI:    test.uri,
+			Time:   time.Now(),
+		}
+		if found, got, err := decide(cfg, req); err != nil {
+			t.Errorf("%s %s: %v", test.method, test.uri, err)
+		} else if found != test.found || got != test.want {
+			t.Errorf("%s %s: got %t %q, want %t %q", test.method, test.uri, found, got, test.found, test.want)
+		}
+	}
+}
+
+func TestParseMethods(t *testing.T) {
+	for in, want := range map[string]string{
+		"":              "",
+		" , ":           "",
+		"GET":           "GET",
+		"head, get":     "GET,HEAD",
+		"POST,PUT,POST": "POST,PUT",
+	} {
+		if got := methodsString(parseMethods(in)); got != want {
+			t.Errorf("parseMethods(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if m := parseMethods(""); m != nil || !m.contains("DELETE") {
+		t.Errorf("empty method set should contain all methods")
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                   "/",
+		"/":                  "/",
+		"/a/b/c/./../../g":   "/a/g",
+		"mid/content=5/../6": "/mid/6",
+		"/a/..":              "/",
+		"/../../a":           "/a",
+		"/%7Euser/%61":       "/~user/a",
+		"/a%2fb":             "/a%2Fb",
+		"/%2e%2E/etc":        "/etc",
+		"/a/%2e/b":           "/a/b",
+		"/100%":              "/100%25",
+		"/a//b":              "/a//b",
+	} {
+		if got := normalizePath(in); got != want {
+			t.Errorf("normalizePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		uri  string
+		want bool
+	}{
+		{"http://archive.ubuntu.com/ubuntu/", true},
+		{"http://archive.ubuntu.com/ubuntu/dists/xenial/Release", true},
+		{"http://archive.ubuntu.com:80/ubuntu/pool/", true},
+		{"http://archive.ubuntu.com/%75buntu/pool/", true},
+		{"http://archive.ubuntu.com/ubuntu/../debian/", false},
+		{"http://archive.ubuntu.com/ubuntu/%2e%2e/debian/", false},
+		{"http://archive.ubuntu.com/ubuntu", false},
+		{"http://archive.ubuntu.com/ubuntu%2Fx/", false},
+		{"http://archive.ubuntu.com:8080/ubuntu/", false},
+		{"http://www.archive.ubuntu.com/ubuntu/", false},
+		{"http://docs.example.org/manual", true},
+		{"http://docs.example.org:8080/manual/index.html", true},
+		{"http://docs.example.org/manual?q=1", true},
+		{"http://docs.example.org/manuals", false},
+		{"http://docs.example.org/", false},
+	} {
+		req := &Request{
+			Proto:  "HTTP",
+			Src:    "127.0.0.3",
+			Method: "GET",
+			URI:    test.uri,
+			Time:   time.Now(),
+		}
+		for _, f := range []func(*Config, *Request) (bool, Action, error){decide, decideLinear} {
+			if found, _, err := f(cfg, req); err != nil {
+				t.Errorf("%s: %v", test.uri, err)
+			} else if found != test.want {
+				t.Errorf("%s: got %t, want %t", test.uri, found, test.want)
+			}
+		}
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	for _, test := range []struct {
+		typ, value string
+		ok         bool
+	}{
+		{"path-prefix", "archive.ubuntu.com/ubuntu/", true},
+		{"path-prefix", "docs.example.org:*/manual", true},
+		{"path-prefix", "http://.example.com:8080/a%20b", true},
+		{"path-prefix", "example.com", true},
+		{"path-prefix", "/ubuntu/", false},
+		{"path-prefix", "http:///ubuntu/", false},
+		{"path-prefix", "example.com/a%zz", false},
+		{"path-prefix", "example.com:http/", false},
+		{"path-prefix", "example.com/a?b", false},
+		{"path-prefix", "user@example.com/", false},
+		{"path-prefix", "https://example.com/", false},
+		{"regex", `http://www\.example\.com/.*`, true},
+		{"regex", `http://(www\.example\.com/.*`, false},
+		{"https-regex", "[", false},
+		{"domain", ".example.com", true},
+		{"nonsense", "example.com", false},
+	} {
+		if err := ValidateRule(test.typ, test.value); (err == nil) != test.ok {
+			t.Errorf("%s %q: got %v, want ok=%t", test.typ, test.value, err, test.ok)
+		}
+	}
+}
+
+func TestHostGlob(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		proto, method, uri string
+		want               bool
+	}{
+		{"HTTP", "GET", "http://foo.blob.core.windows.net/x", true},
+		{"HTTP", "GET", "http://foo.blob.core.windows.net:8080/x", false},
+		{"HTTP", "GET", "http://a.foo.blob.core.windows.net/x", false},
+		{"NONE", "CONNECT", "foo.blob.core.windows.net:443", true},
+		{"NONE", "CONNECT", "foo.blob.core.windows.net:8443", false},
+		{"NONE", "CONNECT", "blob.core.windows.net:443", false},
+		{"HTTP", "GET", "http://updates-eu.vendor.com/", true},
+		{"NONE", "CONNECT", "updates-eu.cdn.vendor.com:8443", true},
+		{"NONE", "CONNECT", "updates.vendor.com:443", false},
+	} {
+		req := &Request{
+			Proto:  test.proto,
+			Src:    "127.0.0.3",
+			Method: test.method,
+			URI:    test.uri,
+			Time:   time.Now(),
+		}
+		for _, f := range []func(*Config, *Request) (bool, Action, error){decide, decideLinear} {
+			if found, _, err := f(cfg, req); err != nil {
+				t.Errorf("%s: %v", test.uri, err)
+			} else if found != test.want {
+				t.Errorf("%s: got %t, want %t", test.uri, found, test.want)
+			}
+		}
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	for in, want := range map[string]string{
+		"bücher.example":      "xn--bcher-kva.example",
+		"München.example.":    "xn--mnchen-3ya.example",
+		"例え.テスト":              "xn--r8jz45g.xn--zckzah",
+		"ＥＸＡＭＰＬＥ.com":         "example.com",
+		"*.Bücher.example":    "*.xn--bcher-kva.example",
+		"Under_Score.example": "under_score.example",
+		"10.0.0.0/8":          "10.0.0.0/8",
+		"::1":                 "::1",
+		"":                    "",
+	} {
+		if got := canonicalHost(in); got != want {
+			t.Errorf("canonicalHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCanonicalURI(t *testing.T) {
+	for _, test := range []struct {
+		proto, method, in, want string
+	}{
+		{"HTTP", "GET", "http://WWW.Example.COM/", "http://www.example.com/"},
+		{"HTTP", "GET", "http://www.example.com./", "http://www.example.com/"},
+		{"HTTP", "GET", "http://www.example.com:80/", "http://www.example.com/"},
+		{"HTTP", "GET", "http://www.example.com:8080/", "http://www.example.com:8080/"},
+		{"HTTP", "GET", "http://www.example.com", "http://www.example.com/"},
+		{"HTTP", "GET", "HTTP://www.example.com/", "http://www.example.com/"},
+		{"HTTP", "GET", "http://bücher.example/", "http://xn--bcher-kva.example/"},
+		{"HTTP", "GET", "http://BÜCHER.example/", "http://xn--bcher-kva.example/"},
+		{"HTTP", "GET", "http://例え.テスト/", "http://xn--r8jz45g.xn--zckzah/"},
+		{"HTTP", "GET", "http://www.example.com/a/./b/../c", "http://www.example.com/a/c"},
+		{"HTTP", "GET", "http://www.example.com/%7euser?q=%7e+%2f", "http://www.example.com/~user?q=~+%2F"},
+		{"HTTP", "GET", "http://www.example.com/#frag", "http://www.example.com/"},
+		{"HTTP", "GET", "http://[::1]:80/", "http://[::1]/"},
+		{"HTTP", "GET", "http://[::1]:81/", "http://[::1]:81/"},
+		{"HTTP", "GET", "http://1.2.3.4:80/x", "http://1.2.3.4/x"},
+		{"HTTP", "GET", "http://bad%zz/", "http://bad%zz/"},
+		{"NONE", "CONNECT", "WWW.Example.COM.:443", "www.example.com:443"},
+		{"NONE", "CONNECT", "bücher.example:443", "xn--bcher-kva.example:443"},
+		{"NONE", "CONNECT", "[::1]:443", "[::1]:443"},
+		{"NONE", "CONNECT", "9.9.0.1", "9.9.0.1"},
+		{"NONE", "GET", "Example.COM:443", "Example.COM:443"},
+	} {
+		if got := canonicalURI(test.proto, test.method, test.in); got != test.want {
+			t.Errorf("canonicalURI(%q, %q, %q) = %q, want %q", test.proto, test.method, test.in, got, test.want)
+		}
+	}
+}
+
+func TestCanonicalMatching(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		proto, method, uri string
+		want               bool
+	}{
+		{"HTTP", "GET", "http://WWW.Google.COM/", true},
+		{"HTTP", "GET", "http://www.google.com./", true},
+		{"HTTP", "GET", "http://bücher.example/", true},
+		{"HTTP", "GET", "http://xn--bcher-kva.example:80/", true},
+		{"NONE", "CONNECT", "BÜCHER.example:443", true},
+		{"HTTP", "GET", "http://exact.example.com/a/b?x", true},
+		{"HTTP", "GET", "http://Exact.Example.com:80/a/c/../b?x", true},
+		{"HTTP", "GET", "http://exact.example.com/a/b?y", false},
+	} {
+		req := &Request{
+			Proto:  test.proto,
+			Src:    "127.0.0.3",
+			Method: test.method,
+			URI:    test.uri,
+			Time:   time.Now(),
+		}
+		for _, f := range []func(*Config, *Request) (bool, Action, error){decide, decideLinear} {
+			if found, _, err := f(cfg, req); err != nil {
+				t.Errorf("%s: %v", test.uri, err)
+			} else if found != test.want {
+				t.Errorf("%s: got %t, want %t", test.uri, found, test.want)
+			}
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		req  Request
+		want Decision
+	}{
+		{
+			Request{Proto: "HTTP", Src: "127.0.0.3", Method: "GET", URI: "http://mail.google.com/"},
+			Decision{Found: true, Action: ActionBlock, SourceID: "kid", GroupID: "kids", ACLID: "kids-web", RuleID: "kw2"},
+		},
+		{
+			Request{Proto: "NONE", Src: "127.0.0.3", Method: "CONNECT", URI: "mail.google.com:443"},
+			Decision{Found: true, Action: ActionAllow, SourceID: "kid", GroupID: "kids", ACLID: "kids-exception", RuleID: "kx1"},
+		},
+		{
+			Request{Proto: "NONE", Src: "127.0.0.2", Method: "CONNECT", URI: "9.10.0.1:443", User: "alice"},
+			Decision{Found: true, Action: ActionAllow, SourceID: "alice", GroupID: "noc", ACLID: "noc-acl", RuleID: "nocrule1"},
+		},
+		{
+			Request{Proto: "HTTP", Src: "128.0.0.1", Method: "GET", URI: "http://www.unencrypted.habets.se/"},
+			Decision{Action: ActionDefault},
+		},
+		{
+			Request{Proto: "HTTP", Src: "127.0.0.3", Method: "GET", URI: "cache_object://localhost/info"},
+			Decision{Found: true, Action: ActionIgnore},
+		},
+	} {
+		test.req.Time = time.Now()
+		got, err := Evaluate(cfg, &test.req)
+		// Depends on the current time. Tested in TestScheduleTTL.
+		got.Expires = time.Time{}
+		if err != nil {
+			t.Errorf("%+v: %v", test.req, err)
+		} else if got != test.want {
+			t.Errorf("%+v: got %+v, want %+v", test.req, got, test.want)
+		}
+	}
+}
+
+func TestScheduleTTL(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2016-01-04 is a Monday. The kids' games schedule starts at 16:00.
+	d, err := Evaluate(cfg, &Request{
+		Proto:  "NONE",
+		Src:    "127.0.0.3",
+		Method: "CONNECT",
+		URI:    "games.example.com:443",
+		Time:   time.Date(2016, 1, 4, 15, 58, 0, 0, time.Local),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2016, 1, 4, 16, 0, 0, 0, time.Local); !d.Expires.Equal(want) {
+		t.Errorf("got expiry %v, want %v", d.Expires, want)
+	}
+}
+
+func TestUserSource(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		user string
+		want bool
+	}{
+		{"", false},
+		{"bob", false},
+		{"alice", true},
+		{"Alice", true},
+	} {
+		req := &Request{
+			Proto:  "NONE",
+			Src:    "127.0.0.2",
+			Method: "CONNECT",
+			URI:    "9.10.0.1:443",
+			User:   test.user,
+			Time:   time.Now(),
+		}
+		v, act, err := decide(cfg, req)
+		if err != nil {
+			t.Errorf("%q: %v", test.user, err)
+			continue
+		}
+		if got := v && act == ActionAllow; got != test.want {
+			t.Errorf("%q: got %t, want %t", test.user, got, test.want)
+		}
+	}
+}
+
+func TestValidity(t *testing.T) {
+	start := time.Date(2016, 1, 4, 12, 0, 0, 0, time.UTC)
+	day := int64(24 * 3600)
+	p := &policy{
+		Sources: []policySource{
+			{SourceID: "laptop", Source: "10.0.0.1/32"},
+			{SourceID: "guest", Source: "10.0.0.2/32"},
+		},
+		Members: []policyMember{
+			{SourceID: "laptop", GroupID: "g"},
+			// Guest until the end of the week.
+			{SourceID: "guest", GroupID: "g", validity: validity{ValidUntil: start.Unix() + 4*day}},
+		},
+		GroupAccess: []policyGroupAccess{
+			{GroupID: "g", ACLID: "a"},
+			// Granted from tomorrow.
+			{GroupID: "g", ACLID: "later", validity: validity{ValidFrom: start.Unix() + day}},
+		},
+		ACLRules: []policyACLRule{
+			{ACLID: "a", RuleID: "week"},
+			{ACLID: "later", RuleID: "tomorrow"},
+		},
+		Rules: []policyRule{
+			// Allowed for a week.
+			{RuleID: "week", Type: "domain", Value: "week.example.com", Action: "allow", validity: validity{ValidUntil: start.Unix() + 7*day}},
+			{RuleID: "tomorrow", Type: "domain", Value: "tomorrow.example.com", Action: "allow"},
+		},
+	}
+	for _, test := range []struct {
+		days    int64
+		changes int64
+		src     string
+		uri     string
+		want    bool
+	}{
+		{0, 1, "10.0.0.1", "http://week.example.com/", true},
+		{0, 1, "10.0.0.2", "http://week.example.com/", true},
+		{0, 1, "10.0.0.1", "http://tomorrow.example.com/", false},
+		{1, 4, "10.0.0.1", "http://tomorrow.example.com/", true},
+		{5, 7, "10.0.0.1", "http://week.example.com/", true},
+		{5, 7, "10.0.0.2", "http://week.example.com/", false},
+		{8, 0, "10.0.0.1", "http://week.example.com/", false},
+		{8, 0, "10.0.0.1", "http://tomorrow.example.com/", true},
+	} {
+		now := start.Add(time.Duration(test.days*day) * time.Second)
+		cfg, err := compile(p, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want time.Time
+		if test.changes != 0 {
+			want = time.Unix(start.Unix()+test.changes*day, 0)
+		}
+		if !cfg.Changes.Equal(want) {
+			t.Errorf("day %d: changes at %v, want %v", test.days, cfg.Changes, want)
+		}
+		d, err := Evaluate(cfg, &Request{Proto: "HTTP", Src: test.src, Method: "GET", URI: test.uri, Time: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.Found && d.Action == ActionAllow; got != test.want {
+			t.Errorf("day %d %s %s: got %t, want %t", test.days, test.src, test.uri, got, test.want)
+		}
+		if !d.Expires.Equal(want) {
+			t.Errorf("day %d %s %s: expires %v, want %v", test.days, test.src, test.uri, d.Expires, want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []Request{
+		{Proto: "HTTP", Src: "127.0.0.3", Method: "GET", URI: "http://mail.google.com/"},
+		{Proto: "NONE", Src: "127.0.0.3", Method: "CONNECT", URI: "mail.google.com:443"},
+		{Proto: "NONE", Src: "127.0.0.2", Method: "CONNECT", URI: "9.10.0.1:443", User: "alice"},
+		{Proto: "HTTP", Src: "128.0.0.1", Method: "GET", URI: "http://www.unencrypted.habets.se/"},
+	} {
+		req.Time = time.Now()
+		want, err := Evaluate(cfg, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, trace, err := Explain(cfg, &req)
+		if err != nil {
+			t.Fatalf("%+v: %v", req, err)
+		}
+		if got != want {
+			t.Errorf("%+v: got %+v, want %+v", req, got, want)
+		}
+
+		// Exactly the deciding rule is marked, in the deciding source.
+		var decided []string
+		for _, s := range trace.Sources {
+			for _, g := range s.Grants {
+				for _, r := range g.Rules {
+					if r.Decided {
+						decided = append(decided, s.SourceID+"/"+g.ACLID+"/"+r.RuleID)
+					}
+					if r.Decided && !r.Matched {
+						t.Errorf("%+v: rule %s decided without matching", req, r.RuleID)
+					}
+				}
+			}
+		}
+		var wantDecided []string
+		if want.Found {
+			wantDecided = []string{want.SourceID + "/" + want.ACLID + "/" + want.RuleID}
+		}
+		if fmt.Sprint(decided) != fmt.Sprint(wantDecided) {
+			t.Errorf("%+v: decided by %q, want %q", req, decided, wantDecided)
+		}
+
+		var buf bytes.Buffer
+		if err := trace.Write(&buf, got); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), "Decision: "+string(want.Action)) {
+			t.Errorf("%+v: no decision in %q", req, buf.String())
+		}
+	}
+
+	if _, _, err := Explain(cfg, &Request{Proto: "HTTP", Src: "bogus", Method: "GET", URI: "http://example.com/"}); err == nil {
+		t.Error("bad source address: want error")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	p := &policy{
+		Sources: []policySource{
+			{SourceID: "new", Source: "10.0.0.1/32"},
+			{SourceID: "old", Source: "10.0.0.2/32"},
+			{SourceID: "net", Source: "10.0.0.0/24"},
+		},
+		Groups: []policyGroup{
+			{GroupID: "onboarding", Monitor: true},
+			{GroupID: "enforced"},
+			{GroupID: "everyone"},
+		},
+		Members: []policyMember{
+			{SourceID: "new", GroupID: "onboarding"},
+			{SourceID: "old", GroupID: "enforced"},
+			{SourceID: "net", GroupID: "everyone"},
+		},
+		GroupAccess: []policyGroupAccess{
+			{GroupID: "enforced", ACLID: "a"},
+			{GroupID: "everyone", ACLID: "b"},
+		},
+		ACLRules: []policyACLRule{
+			{ACLID: "a", RuleID: "allow"},
+			{ACLID: "b", RuleID: "block"},
+		},
+		Rules: []policyRule{
+			{RuleID: "allow", Type: "domain", Value: "allowed.example.com", Action: "allow"},
+			{RuleID: "block", Type: "domain", Value: "blocked.example.com", Action: "block"},
+		},
+	}
+	cfg, err := compile(p, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		src, uri string
+		want     Decision
+	}{
+		// No ACLs for the monitored group, so it only monitors.
+		{"10.0.0.1", "http://other.example.com/", Decision{Action: ActionDefault, Monitor: true, SourceID: "new", GroupID: "onboarding"}},
+		// Blocked by a less specific source in an enforced group.
+		{"10.0.0.1", "http://blocked.example.com/", Decision{Found: true, Action: ActionBlock, SourceID: "net", GroupID: "everyone", ACLID: "b", RuleID: "block"}},
+		{"10.0.0.2", "http://other.example.com/", Decision{Action: ActionDefault}},
+		{"10.0.0.2", "http://allowed.example.com/", Decision{Found: true, Action: ActionAllow, SourceID: "old", GroupID: "enforced", ACLID: "a", RuleID: "allow"}},
+	} {
+		got, err := Evaluate(cfg, &Request{Proto: "HTTP", Src: test.src, Method: "GET", URI: test.uri, Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s %s: got %+v, want %+v", test.src, test.uri, got, test.want)
+		}
+	}
+
+	// A source in a monitored and an enforced group granting the same ACL
+	// is enforced, whatever the order of members.
+	p.GroupAccess = append(p.GroupAccess, policyGroupAccess{GroupID: "onboarding", ACLID: "b"})
+	p.Members = append(p.Members, policyMember{SourceID: "old", GroupID: "onboarding"}, policyMember{SourceID: "old", GroupID: "everyone"})
+	for i := 0; i < 2; i++ {
+		n := len(p.Members)
+		p.Members[n-1], p.Members[n-2] = p.Members[n-2], p.Members[n-1]
+		cfg, err := compile(p, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Evaluate(cfg, &Request{Proto: "HTTP", Src: "10.0.0.2", Method: "GET", URI: "http://blocked.example.com/", Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Decision{Found: true, Action: ActionBlock, SourceID: "old", GroupID: "everyone", ACLID: "b", RuleID: "block"}
+		if got != want {
+			t.Errorf("members %v: got %+v, want %+v", p.Members[n-2:], got, want)
+		}
+	}
+}
+
+func TestGroupDefault(t *testing.T) {
+	now := time.Now()
+	p := &policy{
+		Sources: []policySource{
+			{SourceID: "servers", Source: "10.0.1.0/24"},
+			{SourceID: "staff", Source: "10.0.2.0/24"},
+			{SourceID: "both", Source: "10.0.2.1/32"},
+			{SourceID: "lab", Source: "10.0.3.0/24"},
+			{SourceID: "expired", Source: "10.0.3.1/32"},
+			{SourceID: "new", Source: "10.0.4.0/24"},
+		},
+		Groups: []policyGroup{
+			{GroupID: "servers", DefaultAction: "block"},
+			{GroupID: "staff", DefaultAction: "allow"},
+			{GroupID: "lab"},
+			{GroupID: "onboarding", Monitor: true, DefaultAction: "allow"},
+		},
+		Members: []policyMember{
+			{SourceID: "servers", GroupID: "servers"},
+			{SourceID: "staff", GroupID: "staff"},
+			{SourceID: "both", GroupID: "staff"},
+			{SourceID: "both", GroupID: "servers"},
+			{SourceID: "lab", GroupID: "lab"},
+			{SourceID: "expired", GroupID: "staff", validity: validity{ValidUntil: now.Unix() - 3600}},
+			{SourceID: "new", GroupID: "onboarding"},
+		},
+		GroupAccess: []policyGroupAccess{
+			{GroupID: "staff", ACLID: "a"},
+		},
+		ACLRules: []policyACLRule{
+			{ACLID: "a", RuleID: "block"},
+		},
+		Rules: []policyRule{
+			{RuleID: "block", Type: "domain", Value: "blocked.example.com", Action: "block"},
+		},
+	}
+	cfg, err := compile(p, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		src, uri string
+		want     Decision
+	}{
+		{"10.0.1.1", "http://www.example.com/", Decision{Action: ActionBlock, DefaultGroup: "servers"}},
+		{"10.0.2.2", "http://www.example.com/", Decision{Action: ActionAllow, DefaultGroup: "staff"}},
+		{"10.0.2.2", "http://blocked.example.com/", Decision{Found: true, Action: ActionBlock, SourceID: "staff", GroupID: "staff", ACLID: "a", RuleID: "block"}},
+		// Block beats allow.
+		{"10.0.2.1", "http://www.example.com/", Decision{Action: ActionBlock, DefaultGroup: "servers"}},
+		// No group with a default.
+		{"10.0.3.2", "http://www.example.com/", Decision{Action: ActionDefault}},
+		{"10.0.9.1", "http://www.example.com/", Decision{Action: ActionDefault}},
+		// Membership no longer in effect.
+		{"10.0.3.1", "http://www.example.com/", Decision{Action: ActionDefault}},
+		// Allowed by default, so there's nothing to monitor.
+		{"10.0.4.1", "http://www.example.com/", Decision{Action: ActionAllow, DefaultGroup: "onboarding"}},
+	} {
+		got, err := Evaluate(cfg, &Request{Proto: "HTTP", Src: test.src, Method: "GET", URI: test.uri, Time: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Expires = time.Time{}
+		if got != test.want {
+			t.Errorf("%s %s: got %+v, want %+v", test.src, test.uri, got, test.want)
+		}
+	}
+
+	// The global default applies where no group has one.
+	p.DefaultAction = "allow"
+	if cfg, err = compile(p, now); err != nil {
+		t.Fatal(err)
+	}
+	for src, want := range map[string]Decision{
+		"10.0.9.1": {Action: ActionAllow},
+		"10.0.1.1": {Action: ActionBlock, DefaultGroup: "servers"},
+	} {
+		got, err := Evaluate(cfg, &Request{Proto: "HTTP", Src: src, Method: "GET", URI: "http://www.example.com/", Time: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Expires = time.Time{}
+		if got != want {
+			t.Errorf("%s with global default allow: got %+v, want %+v", src, got, want)
+		}
+	}
+
+	// Bad defaults are rejected, not ignored.
+	p.DefaultAction = "ignore"
+	if _, err := compile(p, now); err == nil {
+		t.Errorf("global default ignore: want error")
+	}
+	p.DefaultAction = ""
+	p.Groups = append(p.Groups, policyGroup{GroupID: "bad", DefaultAction: "ignore"})
+	if _, err := compile(p, now); err == nil {
+		t.Errorf("group default ignore: want error")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := cfg.WriteSnapshot(&b); err != nil {
+		t.Fatal(err)
+	}
+	snap, written, err := LoadSnapshot(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(written) > time.Minute {
+		t.Errorf("snapshot written at %v", written)
+	}
+	re, err := cfg.Recompile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []Request{
+		{Proto: "HTTP", Src: "127.0.0.3", Method: "GET", URI: "http://mail.google.com/"},
+		{Proto: "NONE", Src: "127.0.0.3", Method: "CONNECT", URI: "mail.google.com:443"},
+		{Proto: "NONE", Src: "127.0.0.2", Method: "CONNECT", URI: "9.10.0.1:443", User: "alice"},
+		{Proto: "HTTP", Src: "128.0.0.1", Method: "GET", URI: "http://www.unencrypted.habets.se/"},
+	} {
+		req.Time = time.Now()
+		want, err := Evaluate(cfg, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, c := range map[string]*Config{"snapshot": snap, "recompiled": re} {
+			got, err := Evaluate(c, &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%s %+v: got %+v, want %+v", name, req, got, want)
+			}
+		}
+	}
+
+	again, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]*Config{"snapshot": snap, "recompiled": re, "reloaded": again} {
+		if !cfg.SamePolicy(c) {
+			t.Errorf("%s: not the same policy", name)
+		}
+	}
+	changed := *cfg.src
+	changed.DefaultAction = "allow"
+	for name, c := range map[string]*Config{"changed": {src: &changed}, "no policy": {}} {
+		if cfg.SamePolicy(c) {
+			t.Errorf("%s: same policy", name)
+		}
+	}
+
+	for _, bad := range []string{"", "{}", `{"Version":1}`, `{"Version":2,"Policy":{}}`} {
+		if _, _, err := LoadSnapshot(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestTLSNames(t *testing.T) {
+	now := time.Now()
+	p := &policy{
+		Sources: []policySource{
+			{SourceID: "lan", Source: "10.0.0.0/24"},
+		},
+		Groups: []policyGroup{
+			{GroupID: "lan"},
+		},
+		Members: []policyMember{
+			{SourceID: "lan", GroupID: "lan"},
+		},
+		GroupAccess: []policyGroupAccess{
+			{GroupID: "lan", ACLID: "a"},
+		},
+		ACLRules: []policyACLRule{
+			{ACLID: "a", RuleID: "sni"},
+			{ACLID: "a", RuleID: "cert"},
+			{ACLID: "a", RuleID: "https"},
+			{ACLID: "a", RuleID: "front"},
+		},
+		Rules: []policyRule{
+			{RuleID: "sni", Type: "sni", Value: ".Example.com", Action: "allow"},
+			{RuleID: "cert", Type: "cert-name", Value: "api.vendor.com", Action: "allow"},
+			{RuleID: "https", Type: "https-domain", Value: "www.corp.com", Action: "allow"},
+			{RuleID: "front", Type: "sni", Value: "front.cdn.com", Action: "block"},
+		},
+	}
+	cfg, err := compile(p, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		uri, sni  string
+		certNames []string
+		want      string
+	}{
+		{"93.184.216.34:443", "www.example.com", nil, "sni"},
+		{"93.184.216.34:443", "WWW.EXAMPLE.COM.", nil, "sni"},
+		{"93.184.216.34:443", "example.com", nil, "sni"},
+		{"93.184.216.34:443", "example.org", nil, ""},
+		{"www.example.com:443", "", nil, ""},
+		// A forged SNI or certificate name can't get a named host allowed.
+		{"www.evil.com:443", "www.example.com", nil, ""},
+		{"www.evil.com:443", "", []string{"api.vendor.com"}, ""},
+		// Wildcard certificate names.
+		{"192.0.2.1:443", "", []string{"vendor.com", "*.vendor.com"}, "cert"},
+		{"192.0.2.1:443", "", []string{"*.api.vendor.com"}, ""},
+		{"192.0.2.1:443", "", []string{"*.com"}, ""},
+		// https-domain rules also match on the SNI of a CONNECT.
+		{"192.0.2.2:443", "www.corp.com", nil, "https"},
+		{"192.0.2.2:8443", "www.corp.com", nil, ""},
+		{"www.evil.com:443", "www.corp.com", nil, ""},
+		{"www.corp.com:443", "", nil, "https"},
+		// Block beats allow, whichever name matched.
+		{"www.corp.com:443", "front.cdn.com", nil, "front"},
+	} {
+		req := &Request{Proto: "NONE", Src: "10.0.0.1", Method: "CONNECT", URI: test.uri, SNI: test.sni, CertNames: test.certNames, Time: now}
+		d, err := Evaluate(cfg, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.RuleID != test.want {
+			t.Errorf("%s SNI %q certificate %q: got rule %q, want %q", test.uri, test.sni, test.certNames, d.RuleID, test.want)
+		}
+		found, action, err := decideLinear(cfg, req)
+		if err != nil || found != d.Found || action != d.Action {
+			t.Errorf("%s SNI %q certificate %q: linear got %t %s %v, indexed %t %s", test.uri, test.sni, test.certNames, found, action, err, d.Found, d.Action)
+		}
+	}
+}
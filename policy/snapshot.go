@@ -0,0 +1,86 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+// Snapshots of the policy, so that it can be compiled without the database.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int
+	Written time.Time
+	Policy  *policy
+}
+
+// WriteSnapshot writes the policy the config was compiled from.
+func (cfg *Config) WriteSnapshot(w io.Writer) error {
+	if cfg.src == nil {
+		return fmt.Errorf("config has no policy to snapshot")
+	}
+	return json.NewEncoder(w).Encode(&snapshot{
+		Version: snapshotVersion,
+		Written: time.Now(),
+		Policy:  cfg.src,
+	})
+}
+
+// SamePolicy returns true if cfg and o were compiled from the same policy, so
+// that a snapshot of one is a snapshot of the other.
+func (cfg *Config) SamePolicy(o *Config) bool {
+	return cfg.src != nil && o.src != nil && reflect.DeepEqual(cfg.src, o.src)
+}
+
+// LoadSnapshot compiles a policy written by WriteSnapshot, and returns when
+// it was written.
+func LoadSnapshot(r io.Reader) (*Config, time.Time, error) {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, time.Time{}, fmt.Errorf("bad snapshot: %v", err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, time.Time{}, fmt.Errorf("snapshot version %d, want %d", s.Version, snapshotVersion)
+	}
+	if s.Policy == nil {
+		return nil, time.Time{}, fmt.Errorf("snapshot has no policy")
+	}
+	cfg, err := compile(s.Policy, time.Now())
+	return cfg, s.Written, err
+}
+
+// Recompile compiles the config's policy again, so that rules, grants and
+// memberships that started or stopped being in effect since are, without
+// reloading from the database.
+func (cfg *Config) Recompile() (*Config, error) {
+	return cfg.CompileAt(time.Now())
+}
+
+// CompileAt compiles the config's policy again with the rules, grants and
+// memberships in effect at t, such as to evaluate logged requests as of when
+// they were made.
+func (cfg *Config) CompileAt(t time.Time) (*Config, error) {
+	if cfg.src == nil {
+		return nil, fmt.Errorf("config has no policy to recompile")
+	}
+	return compile(cfg.src, t)
+}
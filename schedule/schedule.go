@@ -0,0 +1,251 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schedule parses and evaluates time-of-day and day-of-week schedules,
+// such as "Mon-Fri 16:00-20:00; Sat-Sun".
+//
+// A schedule is a list of entries separated by ";". Each entry is an optional
+// list of days and an optional time range. Days are comma separated names or
+// ranges of names ("Mon-Fri,Sun"), and default to every day. The time range is
+// "HH:MM-HH:MM", end exclusive, and defaults to all day. A range that ends
+// before it starts continues into the next day, so "Fri 22:00-02:00" is
+// active until 2am Saturday. The empty schedule is always active.
+//
+// Schedules are evaluated in the time zone of the time passed in.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const minutesPerDay = 24 * 60
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type span struct {
+	days [7]bool
+
+	// Minutes since midnight. If end <= start the span wraps past midnight.
+	start, end int
+}
+
+// Schedule is a parsed schedule. The nil Schedule is always active.
+type Schedule struct {
+	text  string
+	spans []span
+}
+
+// Parse parses a schedule. The empty string gives a nil Schedule, which is
+// always active.
+func Parse(s string) (*Schedule, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	ret := &Schedule{text: s}
+	for _, e := range strings.Split(s, ";") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		sp, err := parseSpan(e)
+		if err != nil {
+			return nil, fmt.Errorf("schedule entry %q: %v", e, err)
+		}
+		ret.spans = append(ret.spans, sp)
+	}
+	return ret, nil
+}
+
+func parseSpan(s string) (span, error) {
+	sp := span{end: minutesPerDay}
+	var haveDays, haveTime bool
+	for _, f := range strings.Fields(s) {
+		if f[0] >= '0' && f[0] <= '9' {
+			if haveTime {
+				return span{}, fmt.Errorf("more than one time range")
+			}
+			haveTime = true
+			var err error
+			if sp.start, sp.end, err = parseTimeRange(f); err != nil {
+				return span{}, err
+			}
+			continue
+		}
+		if haveDays {
+			return span{}, fmt.Errorf("more than one list of days")
+		}
+		haveDays = true
+		if err := parseDays(f, &sp.days); err != nil {
+			return span{}, err
+		}
+	}
+	if !haveDays {
+		for n := range sp.days {
+			sp.days[n] = true
+		}
+	}
+	return sp, nil
+}
+
+func parseDay(s string) (time.Weekday, error) {
+	d, found := dayNames[strings.ToLower(s)]
+	if !found {
+		return 0, fmt.Errorf("unknown day %q", s)
+	}
+	return d, nil
+}
+
+func parseDays(s string, days *[7]bool) error {
+	for _, r := range strings.Split(s, ",") {
+		ds := strings.Split(r, "-")
+		switch len(ds) {
+		case 1:
+			d, err := parseDay(ds[0])
+			if err != nil {
+				return err
+			}
+			days[d] = true
+		case 2:
+			from, err := parseDay(ds[0])
+			if err != nil {
+				return err
+			}
+			to, err := parseDay(ds[1])
+			if err != nil {
+				return err
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				days[d] = true
+				if d == to {
+					break
+				}
+			}
+		default:
+			return fmt.Errorf("bad day range %q", r)
+		}
+	}
+	return nil
+}
+
+func parseTime(s string) (int, error) {
+	hm := strings.Split(s, ":")
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil {
+		return 0, fmt.Errorf("bad hour in %q: %v", s, err)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil {
+		return 0, fmt.Errorf("bad minute in %q: %v", s, err)
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > minutesPerDay {
+		return 0, fmt.Errorf("time %q out of range", s)
+	}
+	return h*60 + m, nil
+}
+
+func parseTimeRange(s string) (int, int, error) {
+	se := strings.Split(s, "-")
+	if len(se) != 2 {
+		return 0, 0, fmt.Errorf("bad time range %q, want HH:MM-HH:MM", s)
+	}
+	start, err := parseTime(se[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseTime(se[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == minutesPerDay {
+		return 0, 0, fmt.Errorf("time range %q starts at end of day", s)
+	}
+	return start, end, nil
+}
+
+func (sp *span) active(t time.Time) bool {
+	wd := t.Weekday()
+	m := t.Hour()*60 + t.Minute()
+	if sp.start < sp.end {
+		return sp.days[wd] && m >= sp.start && m < sp.end
+	}
+	// Wraps past midnight.
+	return (sp.days[wd] && m >= sp.start) || (sp.days[(wd+6)%7] && m < sp.end)
+}
+
+// Active returns true if the schedule is active at t.
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	for n := range s.spans {
+		if s.spans[n].active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the first time after t when the schedule changes between
+// active and inactive. It returns false if it never changes.
+func (s *Schedule) Next(t time.Time) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	now := s.Active(t)
+
+	// The schedule can only change at midnight and at the start and end of
+	// spans. Looking eight days ahead covers every weekday. The earliest of
+	// these where it's not the same as now is the next change, since it
+	// doesn't change between them.
+	var next time.Time
+	found := false
+	y, mo, d := t.Date()
+	check := func(c time.Time) {
+		if c.After(t) && (!found || c.Before(next)) && s.Active(c) != now {
+			next, found = c, true
+		}
+	}
+	for day := 0; day <= 8; day++ {
+		check(time.Date(y, mo, d+day, 0, 0, 0, 0, t.Location()))
+		for _, sp := range s.spans {
+			check(time.Date(y, mo, d+day, 0, sp.start, 0, 0, t.Location()))
+			check(time.Date(y, mo, d+day, 0, sp.end, 0, 0, t.Location()))
+		}
+	}
+	return next, found
+}
+
+// String returns the schedule as it was parsed.
+func (s *Schedule) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.text
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2016 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActive(t *testing.T) {
+	// 2016-01-04 is a Monday.
+	at := func(day, h, m int) time.Time {
+		return time.Date(2016, 1, 3+day, h, m, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		sched string
+		t     time.Time
+		want  bool
+	}{
+		{"", at(1, 12, 0), true},
+		{"Mon-Fri 16:00-20:00; Sat-Sun", at(1, 16, 0), true},
+		{"Mon-Fri 16:00-20:00; Sat-Sun", at(1, 19, 59), true},
+		{"Mon-Fri 16:00-20:00; Sat-Sun", at(1, 20, 0), false},
+		{"Mon-Fri 16:00-20:00; Sat-Sun", at(1, 15, 59), false},
+		{"Mon-Fri 16:00-20:00; Sat-Sun", at(6, 3, 0), true},
+		{"Mon-Fri 16:00-20:00; Sat-Sun", at(0, 23, 59), true},
+		{"mon,wed", at(2, 12, 0), false},
+		{"mon,wed", at(3, 12, 0), true},
+		{"Fri-Mon", at(2, 12, 0), false},
+		{"Fri-Mon", at(1, 12, 0), true},
+		{"08:00-17:00", at(4, 8, 0), true},
+		{"08:00-17:00", at(4, 17, 0), false},
+		{"12:00-24:00", at(4, 23, 59), true},
+		{"Fri 22:00-02:00", at(5, 23, 0), true},
+		{"Fri 22:00-02:00", at(6, 1, 59), true},
+		{"Fri 22:00-02:00", at(6, 2, 0), false},
+		{"Fri 22:00-02:00", at(5, 1, 0), false},
+	} {
+		s, err := Parse(test.sched)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.sched, err)
+			continue
+		}
+		if got := s.Active(test.t); got != test.want {
+			t.Errorf("%q at %v: got %t, want %t", test.sched, test.t, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"Mon-",
+		"Monday",
+		"Mon Tue",
+		"8-17",
+		"08:00-17:00 09:00-10:00",
+		"25:00-26:00",
+		"24:00-01:00",
+		"08:60-09:00",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// 2016-01-04 is a Monday.
+	at := func(day, h, m int) time.Time {
+		return time.Date(2016, 1, 3+day, h, m, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		sched string
+		t     time.Time
+		want  time.Time
+		found bool
+	}{
+		{"", at(1, 12, 0), time.Time{}, false},
+		{"Mon-Sun", at(1, 12, 0), time.Time{}, false},
+		{"Mon-Fri 16:00-20:00", at(1, 12, 0), at(1, 16, 0), true},
+		{"Mon-Fri 16:00-20:00", at(1, 16, 0), at(1, 20, 0), true},
+		{"Mon-Fri 16:00-20:00", at(1, 19, 59), at(1, 20, 0), true},
+		{"Mon-Fri 16:00-20:00", at(5, 21, 0), at(8, 16, 0), true},
+		{"Mon-Fri 16:00-20:00; Sat-Sun", at(5, 21, 0), at(6, 0, 0), true},
+		{"Mon-Fri 16:00-20:00; Sat-Sun", at(6, 12, 0), at(8, 0, 0), true},
+		{"Fri 22:00-02:00", at(5, 23, 0), at(6, 2, 0), true},
+		{"Sat", at(1, 12, 0), at(6, 0, 0), true},
+		{"Sat", at(6, 12, 0), at(7, 0, 0), true},
+	} {
+		s, err := Parse(test.sched)
+		if err != nil {
+			t.Fatalf("%q: %v", test.sched, err)
+		}
+		got, found := s.Next(test.t)
+		if found != test.found || !got.Equal(test.want) {
+			t.Errorf("%q at %v: got %v %t, want %v %t", test.sched, test.t, got, found, test.want, test.found)
+		}
+	}
+}
@@ -53,3 +53,51 @@ INSERT INTO acls(acl_id) VALUES('noc-acl');
 INSERT INTO rules(rule_id, type, value, action) VALUES('nocrule1', 'https-domain', '9.10.0.1:*', 'allow');
 INSERT INTO aclrules(acl_id, rule_id) VALUES('noc-acl', 'nocrule1');
 INSERT INTO groupaccess(group_id, acl_id) VALUES('noc', 'noc-acl');
+
+INSERT INTO sources(source_id, source) VALUES('kid', '127.0.0.3/32');
+INSERT INTO groups(group_id) VALUES('kids');
+INSERT INTO members(source_id, group_id) VALUES('kid', 'kids');
+INSERT INTO acls(acl_id) VALUES('games');
+INSERT INTO rules(rule_id, type, value, action) VALUES('gamerule1', 'https-domain', 'games.example.com', 'allow');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('games', 'gamerule1');
+INSERT INTO groupaccess(group_id, acl_id, schedule) VALUES('kids', 'games', 'Mon-Fri 16:00-20:00; Sat-Sun');
+
+INSERT INTO sources(source_id, source) VALUES('alice', 'user:Alice');
+INSERT INTO members(source_id, group_id) VALUES('alice', 'noc');
+
+INSERT INTO acls(acl_id) VALUES('kids-web');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw1', 'domain',       '.google.com',     'allow');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw2', 'domain',       'mail.google.com', 'block');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw3', 'https-domain', '.google.com',     'allow');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw4', 'https-domain', 'mail.google.com', 'block');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw1');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw2');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw3');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw4');
+INSERT INTO groupaccess(group_id, acl_id) VALUES('kids', 'kids-web');
+INSERT INTO acls(acl_id, priority) VALUES('kids-exception', 10);
+INSERT INTO rules(rule_id, type, value, action) VALUES('kx1', 'https-domain', 'mail.google.com', 'allow');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-exception', 'kx1');
+INSERT INTO groupaccess(group_id, acl_id) VALUES('kids', 'kids-exception');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw5', 'domain', 'paste.example.com', 'allow');
+INSERT INTO rules(rule_id, type, value, action, methods) VALUES('kw6', 'domain', 'paste.example.com', 'block', 'POST,PUT');
+INSERT INTO rules(rule_id, type, value, action, methods) VALUES('kw7', 'domain', 'mirror.example.com', 'allow', 'GET,HEAD');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw5');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw6');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw7');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw8', 'path-prefix', 'archive.ubuntu.com/ubuntu/', 'allow');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw9', 'path-prefix', 'docs.example.org:*/manual', 'allow');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw8');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw9');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw10', 'host-glob', '*.blob.core.windows.net', 'allow');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw11', 'host-glob', 'updates-**.vendor.com:*', 'allow');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw10');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw11');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw12', 'domain',       'Bücher.example.', 'allow');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw13', 'https-domain', 'bücher.example',  'allow');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw14', 'exact',        'HTTP://exact.example.com:80/a/./b?x', 'allow');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw12');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw13');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw14');
+INSERT INTO rules(rule_id, type, value, action) VALUES('kw15', 'exact',        'http://exact.example.com/a+b', 'allow');
+INSERT INTO aclrules(acl_id, rule_id) VALUES('kids-web', 'kw15');